@@ -3,11 +3,15 @@ package cache
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"net/http"
 
@@ -15,6 +19,7 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/puzpuzpuz/xsync"
 	"go.uber.org/zap"
 )
 
@@ -24,20 +29,56 @@ type Cache struct {
 	PurgePath          string
 	PurgeKeyHeader     string
 	PurgeKey           string
+	PurgeHostHeader    string
 	CacheHeaderName    string
+	CacheKey           string
+	CacheQuery         string
+	CacheQueryParams   []string
+	CacheQueryStrip    []string
+	IgnoreHost         bool
 	BypassPathPrefixes []string
 	BypassPathRegex    string
 	BypassHome         bool
 	BypassDebugQuery   string
+	BypassCookies      []string
+	VaryCookies        []string
+	BypassMatchersRaw  caddyhttp.RawMatcherSets `caddy:"namespace=http.matchers"`
 	CacheResponseCodes []string
+	IgnoreCacheControl bool
+	IgnoreSetCookie    bool
+	CacheHeaders       []string
+	HeadFill           bool
+	StoreEncoding      string
+	TranscodeMemory    bool
+	Fsync              bool
+	EncodingPrefer     []string
+	CoalesceTimeout    int
+	FillWorkers        int
+	FillQueueSize      int
 	TTL                int
+	TTLRules           []TTLRule
+	TTLMin             int
+	TTLMax             int
+	StaleTTL           int
+	StaleErrorTTL      int
 	Store              *Store
 
 	MemoryItemMaxSize   int
 	MemoryCacheMaxSize  int
 	MemoryCacheMaxCount int
 
-	pathRx *regexp.Regexp
+	pathRx         *regexp.Regexp
+	bypassCookies  *cookieMatcher
+	varyCookies    *cookieMatcher
+	bypassMatchers caddyhttp.MatcherSets
+	cacheHeaders   []string
+
+	// refresh and fill keys in background
+	fills *fillQueue
+	// keys filling by a request, other requests wait for it
+	filling *xsync.MapOf[string, *fillCall]
+	// keys not cacheable recently to expire time, not coalesced
+	passing *LRUCache[string, int64]
 }
 
 func init() {
@@ -61,6 +102,36 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		key := d.Val()
 
+		// bypass {
+		// 	header X-Preview *
+		// 	remote_ip 10.0.0.0/8
+		// }
+		// every block is one matcher set, bypass if any set match
+		if key == "bypass" {
+			matcherSet, err := caddyhttp.ParseCaddyfileNestedMatcherSet(d)
+			if err != nil {
+				return err
+			}
+			c.BypassMatchersRaw = append(c.BypassMatchersRaw, matcherSet)
+			continue
+		}
+
+		// ttl_rules {
+		// 	path / 60
+		// 	path /category/* /tag/* 3600
+		// 	status 404 30
+		// }
+		if key == "ttl_rules" {
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				rule, err := parseTTLRule(d)
+				if err != nil {
+					return err
+				}
+				c.TTLRules = append(c.TTLRules, rule)
+			}
+			continue
+		}
+
 		if !d.Args(&value) {
 			continue
 		}
@@ -93,16 +164,83 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		case "bypass_debug_query":
 			c.BypassDebugQuery = strings.TrimSpace(value)
 
+		case "bypass_cookies":
+			// name prefix, or regex start with `~`, `none` to disable
+			c.BypassCookies = []string{}
+			if strings.ToLower(value) != "none" {
+				c.BypassCookies = splitList(append([]string{value}, d.RemainingArgs()...))
+			}
+
+		case "vary_cookies":
+			c.VaryCookies = splitList(append([]string{value}, d.RemainingArgs()...))
+
 		case "cache_response_codes":
-			codes := strings.Split(strings.TrimSpace(value), ",")
-			c.CacheResponseCodes = make([]string, len(codes))
+			c.CacheResponseCodes = parseStatusCodes(value)
+
+		case "ignore_cache_control":
+			if strings.ToLower(value) == "true" {
+				c.IgnoreCacheControl = true
+			}
+
+		case "ignore_set_cookie":
+			if strings.ToLower(value) == "true" {
+				c.IgnoreSetCookie = true
+			}
 
-			for i, code := range codes {
-				code = strings.TrimSpace(code)
-				if strings.Contains(code, "XX") {
-					code = string(code[0])
+		case "cache_headers":
+			// cache_headers Link X-Custom ...  replace the default list
+			// cache_headers +X-Custom -Server  add to or remove from the default list
+			c.CacheHeaders = splitList(append([]string{value}, d.RemainingArgs()...))
+
+		case "store_encoding":
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value != "all" && !slices.Contains(CachedContentEncoding, value) {
+				return d.Errf("invalid store_encoding: %s", value)
+			}
+			c.StoreEncoding = value
+
+		case "encoding_prefer":
+			c.EncodingPrefer = splitList(append([]string{value}, d.RemainingArgs()...))
+			for _, ce := range c.EncodingPrefer {
+				if ce == "none" || !slices.Contains(CachedContentEncoding, ce) {
+					return d.Errf("invalid encoding_prefer: %s", ce)
 				}
-				c.CacheResponseCodes[i] = code
+			}
+
+		case "coalesce_timeout":
+			timeout, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid coalesce_timeout value: %v", err)
+			}
+			c.CoalesceTimeout = timeout
+
+		case "fill_workers":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid fill_workers value: %v", err)
+			}
+			c.FillWorkers = n
+
+		case "fill_queue_size":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid fill_queue_size value: %v", err)
+			}
+			c.FillQueueSize = n
+
+		case "transcode_memory":
+			if strings.ToLower(value) == "true" {
+				c.TranscodeMemory = true
+			}
+
+		case "head_fill":
+			if strings.ToLower(value) == "true" {
+				c.HeadFill = true
+			}
+
+		case "fsync":
+			if strings.ToLower(value) == "true" {
+				c.Fsync = true
 			}
 
 		case "ttl":
@@ -113,6 +251,34 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			}
 			c.TTL = ttl
 
+		case "ttl_min":
+			ttl, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid ttl_min value: %v", err)
+			}
+			c.TTLMin = ttl
+
+		case "ttl_max":
+			ttl, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid ttl_max value: %v", err)
+			}
+			c.TTLMax = ttl
+
+		case "stale_while_revalidate":
+			ttl, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid stale_while_revalidate value: %v", err)
+			}
+			c.StaleTTL = ttl
+
+		case "stale_if_error":
+			ttl, err := strconv.Atoi(value)
+			if err != nil {
+				return d.Errf("invalid stale_if_error value: %v", err)
+			}
+			c.StaleErrorTTL = ttl
+
 		case "purge_path":
 			c.PurgePath = value
 
@@ -122,9 +288,40 @@ func (c *Cache) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		case "purge_key_header":
 			c.PurgeKeyHeader = value
 
+		case "purge_host_header":
+			c.PurgeHostHeader = value
+
+		case "ignore_host":
+			if strings.ToLower(value) == "true" {
+				c.IgnoreHost = true
+			}
+
 		case "cache_header_name":
 			c.CacheHeaderName = value
 
+		case "cache_key":
+			c.CacheKey = strings.TrimSpace(value)
+
+		case "cache_query":
+			// cache_query ignore|all
+			// cache_query allow|deny param1,param2 ...
+			value = strings.ToLower(strings.TrimSpace(value))
+			switch value {
+			case QueryIgnore, QueryAll:
+			case QueryAllow, QueryDeny:
+				c.CacheQueryParams = splitList(d.RemainingArgs())
+			default:
+				return d.Errf("invalid cache_query policy: %s", value)
+			}
+			c.CacheQuery = value
+
+		case "cache_query_strip":
+			// `cache_query_strip none` to keep all tracking params
+			c.CacheQueryStrip = []string{}
+			if strings.ToLower(value) != "none" {
+				c.CacheQueryStrip = splitList(append([]string{value}, d.RemainingArgs()...))
+			}
+
 		case "memory_item_max_size":
 			if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
 				c.MemoryItemMaxSize = int(n)
@@ -152,16 +349,7 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 	}
 
 	if c.CacheResponseCodes == nil {
-		codes := strings.Split(os.Getenv("CACHE_RESPONSE_CODES"), ",")
-		c.CacheResponseCodes = make([]string, len(codes))
-
-		for i, code := range codes {
-			code = strings.TrimSpace(code)
-			if strings.Contains(code, "XX") {
-				code = string(code[0])
-			}
-			c.CacheResponseCodes[i] = code
-		}
+		c.CacheResponseCodes = parseStatusCodes(os.Getenv("CACHE_RESPONSE_CODES"))
 	}
 
 	if c.BypassPathPrefixes == nil {
@@ -193,6 +381,116 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	if !c.IgnoreCacheControl {
+		if strings.ToLower(os.Getenv("CACHE_IGNORE_CACHE_CONTROL")) == "true" {
+			c.IgnoreCacheControl = true
+		}
+	}
+
+	if !c.IgnoreSetCookie {
+		if strings.ToLower(os.Getenv("CACHE_IGNORE_SET_COOKIE")) == "true" {
+			c.IgnoreSetCookie = true
+		}
+	}
+
+	if c.CacheHeaders == nil {
+		c.CacheHeaders = splitList([]string{os.Getenv("CACHE_HEADERS")})
+	}
+	c.cacheHeaders = buildHeaderList(c.CacheHeaders)
+
+	if c.StoreEncoding == "" {
+		c.StoreEncoding = strings.ToLower(strings.TrimSpace(os.Getenv("CACHE_STORE_ENCODING")))
+	}
+	// all encodings is the default
+	if c.StoreEncoding == "all" {
+		c.StoreEncoding = ""
+	}
+	if c.StoreEncoding != "" && !slices.Contains(CachedContentEncoding, c.StoreEncoding) {
+		return fmt.Errorf("invalid store encoding: %s", c.StoreEncoding)
+	}
+
+	if c.EncodingPrefer == nil {
+		c.EncodingPrefer = splitList([]string{os.Getenv("CACHE_ENCODING_PREFER")})
+	}
+	if len(c.EncodingPrefer) == 0 {
+		c.EncodingPrefer = defaultEncodingPrefer
+	}
+
+	if c.CoalesceTimeout == 0 {
+		timeout, err := strconv.Atoi(os.Getenv("CACHE_COALESCE_TIMEOUT"))
+		if err != nil || timeout == 0 {
+			// long enough for most of pages
+			timeout = 10
+		}
+		c.CoalesceTimeout = timeout
+	}
+
+	if c.FillWorkers <= 0 {
+		n, err := strconv.Atoi(os.Getenv("CACHE_FILL_WORKERS"))
+		if err != nil || n <= 0 {
+			n = 4
+		}
+		c.FillWorkers = n
+	}
+
+	if c.FillQueueSize <= 0 {
+		n, err := strconv.Atoi(os.Getenv("CACHE_FILL_QUEUE_SIZE"))
+		if err != nil || n <= 0 {
+			n = 256
+		}
+		c.FillQueueSize = n
+	}
+
+	if !c.TranscodeMemory {
+		if strings.ToLower(os.Getenv("CACHE_TRANSCODE_MEMORY")) == "true" {
+			c.TranscodeMemory = true
+		}
+	}
+
+	if !c.HeadFill {
+		if strings.ToLower(os.Getenv("CACHE_HEAD_FILL")) == "true" {
+			c.HeadFill = true
+		}
+	}
+
+	if !c.Fsync {
+		if strings.ToLower(os.Getenv("CACHE_FSYNC")) == "true" {
+			c.Fsync = true
+		}
+	}
+
+	if c.BypassMatchersRaw != nil {
+		matcherSets, err := ctx.LoadModule(c, "BypassMatchersRaw")
+		if err != nil {
+			return fmt.Errorf("loading bypass matchers: %v", err)
+		}
+		err = c.bypassMatchers.FromInterface(matcherSets)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.BypassCookies == nil {
+		c.BypassCookies = defaultBypassCookies
+		if env := os.Getenv("BYPASS_COOKIES"); env != "" {
+			c.BypassCookies = splitList([]string{env})
+		}
+	}
+	bypassCookies, err := newCookieMatcher(c.BypassCookies)
+	if err != nil {
+		return err
+	}
+	c.bypassCookies = bypassCookies
+
+	if c.VaryCookies == nil {
+		c.VaryCookies = splitList([]string{os.Getenv("VARY_COOKIES")})
+	}
+	varyCookies, err := newCookieMatcher(c.VaryCookies)
+	if err != nil {
+		return err
+	}
+	c.varyCookies = varyCookies
+
 	if c.TTL == 0 {
 		ttl, err := strconv.Atoi(os.Getenv("TTL"))
 		if err != nil {
@@ -201,6 +499,29 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		c.TTL = ttl
 	}
 
+	for i := range c.TTLRules {
+		err := c.TTLRules[i].Path.Provision(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.TTLMin == 0 {
+		c.TTLMin, _ = strconv.Atoi(os.Getenv("TTL_MIN"))
+	}
+
+	if c.TTLMax == 0 {
+		c.TTLMax, _ = strconv.Atoi(os.Getenv("TTL_MAX"))
+	}
+
+	if c.StaleTTL == 0 {
+		c.StaleTTL, _ = strconv.Atoi(os.Getenv("STALE_TTL"))
+	}
+
+	if c.StaleErrorTTL == 0 {
+		c.StaleErrorTTL, _ = strconv.Atoi(os.Getenv("STALE_ERROR_TTL"))
+	}
+
 	if c.PurgePath == "" {
 		c.PurgePath = os.Getenv("PURGE_PATH")
 
@@ -220,6 +541,19 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	if c.PurgeHostHeader == "" {
+		c.PurgeHostHeader = os.Getenv("PURGE_HOST_HEADER")
+		if c.PurgeHostHeader == "" {
+			c.PurgeHostHeader = "X-WPSidekick-Purge-Host"
+		}
+	}
+
+	if !c.IgnoreHost {
+		if strings.ToLower(os.Getenv("CACHE_IGNORE_HOST")) == "true" {
+			c.IgnoreHost = true
+		}
+	}
+
 	if c.CacheHeaderName == "" {
 		c.CacheHeaderName = os.Getenv("CACHE_HEADER_NAME")
 		if c.CacheHeaderName == "" {
@@ -227,6 +561,23 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		}
 	}
 
+	if c.CacheKey == "" {
+		c.CacheKey = os.Getenv("CACHE_KEY")
+	}
+	c.CacheKey = expandShorthands(c.CacheKey)
+	if key, ok := stripURIPlaceholders(c.CacheKey); ok {
+		c.logger.Warn("wp cache - path and query placeholders removed from cache_key, the key always starts with the normalized path and query", zap.String("cache_key", key))
+		c.CacheKey = key
+	}
+
+	if c.CacheQuery == "" {
+		c.CacheQuery = QueryAll
+	}
+
+	if c.CacheQueryStrip == nil {
+		c.CacheQueryStrip = defaultQueryStrip
+	}
+
 	// TODO: let 0 == disable memory but cache to disk?
 	if c.MemoryItemMaxSize == 0 {
 		c.MemoryItemMaxSize = 4 * 1024 * 1024 // 4MB
@@ -245,7 +596,12 @@ func (c *Cache) Provision(ctx caddy.Context) error {
 		c.MemoryCacheMaxCount = 32 * 1024 // 32K item as default should be enough?
 	}
 
-	c.Store = NewStore(c.Loc, c.TTL, c.MemoryCacheMaxSize, c.MemoryCacheMaxCount, c.logger)
+	c.fills = newFillQueue(c.FillWorkers, c.FillQueueSize, c.logger, func(ctx context.Context, job *fillJob) {
+		c.doCache(ctx, job.r, job.next, job.cacheHost, job.cacheKey)
+	})
+	c.filling = xsync.NewMapOf[*fillCall]()
+	c.passing = NewLRUCache[string, int64](PASS_MAX_KEYS, -1)
+	c.Store = NewStore(c.Loc, c.TTL, c.MemoryCacheMaxSize, c.MemoryCacheMaxCount, c.StoreEncoding, c.TranscodeMemory, c.Fsync, c.logger)
 
 	return nil
 }
@@ -271,21 +627,37 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		if key != c.PurgeKey {
 			c.logger.Warn("wp cache - purge - invalid key", zap.String("path", r.URL.Path))
 		} else {
+			// scope to the requesting host, `*` in purge host header for all hosts
+			purgeHost := c.requestHost(r)
+			if h := reqHdr.Get(c.PurgeHostHeader); h != "" {
+				purgeHost = normalizeHost(h)
+				if h == "*" {
+					purgeHost = ""
+				}
+			}
+
 			switch r.Method {
 			case "GET":
-				cacheList := db.List()
+				cacheList := db.List(purgeHost)
+				cacheList["debug"] = append(cacheList["debug"], c.fills.Stats()...)
 				json.NewEncoder(w).Encode(cacheList)
 				return nil
 
 			case "POST":
 				pathToPurge := strings.Replace(r.URL.Path, c.PurgePath, "", 1)
-				c.logger.Debug("wp cache - purge", zap.String("path", pathToPurge))
+				c.logger.Debug("wp cache - purge", zap.String("host", purgeHost), zap.String("path", pathToPurge), zap.String("query", r.URL.RawQuery))
 
-				// TODO: fix concurrent issue when flush/pruge running and new cache setting
+				// with query only purge that page, otherwise purge all pages with the path prefix
+				query := c.normalizeQuery(r.URL.RawQuery)
+				if query != "" {
+					pathToPurge = db.buildCacheKey(pathToPurge+"?"+query, "")
+				}
+
+				// wait until done, the purged content is never served after response
 				if len(pathToPurge) < 2 {
-					go db.Flush()
+					db.Flush(purgeHost)
 				} else {
-					go db.Purge(pathToPurge)
+					db.Purge(purgeHost, pathToPurge)
 				}
 				w.Write([]byte("OK"))
 				return nil
@@ -293,8 +665,8 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		}
 	}
 
-	// only GET Method can cache
-	if r.Method != "GET" {
+	// only GET Method can cache, HEAD served from the GET entry
+	if r.Method != "GET" && r.Method != "HEAD" {
 		return next.ServeHTTP(w, r)
 	}
 
@@ -325,11 +697,21 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		bypass = true
 	}
 
+	// bypass by matchers in `bypass` blocks
+	if !bypass && len(c.bypassMatchers) > 0 {
+		bypass = c.bypassMatchers.AnyMatch(r)
+		if bypass {
+			c.logger.Debug("wp cache - bypass matcher", zap.String("path", r.URL.Path))
+		}
+	}
+
 	// bypass if is logged in. We don't want to cache admin bars
+	// also cart, commenter and password protected posts by default
 	if !bypass {
 		cookies := r.Cookies()
 		for _, cookie := range cookies {
-			if strings.HasPrefix(cookie.Name, "wordpress_logged_in") {
+			if c.bypassCookies.Match(cookie.Name) {
+				c.logger.Debug("wp cache - bypass cookie", zap.String("cookie", cookie.Name))
 				bypass = true
 				break
 			}
@@ -342,77 +724,236 @@ func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp
 		return next.ServeHTTP(w, r)
 	}
 
-	// TODO: custom cacheKey by query, header ...
-	cacheKey := ""
-	cacheKey = c.Store.buildCacheKey(r.URL.Path, cacheKey)
+	cacheHost := c.requestHost(r)
+	cacheKey := c.buildRequestKey(r)
 
-	requestEncoding := strings.Split(strings.Join(reqHdr["Accept-Encoding"], ""), ",")
-	if len(requestEncoding) == 1 && len(requestEncoding[0]) == 0 {
-		requestEncoding = nil
+	requestEncoding := negotiateEncoding(reqHdr.Values("Accept-Encoding"), c.EncodingPrefer)
+	// client accepts none of cached encodings, let backend decide
+	if len(requestEncoding) == 0 {
+		hdr.Set(c.CacheHeaderName, "BYPASS")
+		return next.ServeHTTP(w, r)
+	}
+
+	cacheData, cacheMeta, ce, err := c.lookup(r, cacheHost, cacheKey, requestEncoding)
+	if err == nil || errors.Is(err, ErrCacheStale) {
+		c.serveCache(w, r, next, cacheHost, cacheKey, cacheData, cacheMeta, ce, err)
+		return nil
 	}
-	requestEncoding = append(requestEncoding, "none")
 
-	// TODO: if only have uncompressed data, we should try to cached a compressed version
+	// HEAD response has no body to cache, fill the GET entry in background if enabled
+	if r.Method == "HEAD" {
+		if c.HeadFill {
+			c.queueFill(r, next, cacheHost, cacheKey)
+		}
+		hdr.Set(c.CacheHeaderName, "MISS")
+		return next.ServeHTTP(w, r)
+	}
+
+	// partial response from backend can not be cached, fill the full body in background,
+	// later ranges are served from it
+	if r.Header.Get("Range") != "" {
+		c.queueFill(r, next, cacheHost, cacheKey)
+		hdr.Set(c.CacheHeaderName, "MISS")
+		return next.ServeHTTP(w, r)
+	}
+	c.logger.Debug("wp cache - error - "+cacheKey, zap.Error(err))
+
+	// only one request runs backend for the same key, others wait and served from cache,
+	// or run backend by themselves if it is not cached
+	fid := fillID(cacheHost, cacheKey)
+	call, leader := c.joinFill(fid)
+	if !leader && c.waitFill(r, call) {
+		cacheData, cacheMeta, ce, err = c.lookup(r, cacheHost, cacheKey, requestEncoding)
+		if err == nil || errors.Is(err, ErrCacheStale) {
+			c.serveCache(w, r, next, cacheHost, cacheKey, cacheData, cacheMeta, ce, err)
+			return nil
+		}
+	}
+
+	nw := NewCustomWriter(w, r, db, c.logger, c, cacheHost, cacheKey)
+	if errors.Is(err, ErrCacheExpired) && cacheData != nil {
+		nw.SetStale(cacheData, cacheMeta, ce)
+	}
+	defer func() {
+		nw.Close()
+		c.recordPass(fid, nw.stored, nw.bypassReason != "")
+		if leader {
+			c.finishFill(fid, call, nw.stored)
+		}
+	}()
+	err = next.ServeHTTP(nw, r)
+	if err != nil && nw.ServeStale(err) {
+		return nil
+	}
+	return err
+}
+
+// serveCache writes the entry found by lookup, err is nil or ErrCacheStale
+func (c *Cache) serveCache(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, cacheHost string, cacheKey string, cacheData []byte, cacheMeta *CacheMeta, ce string, err error) {
+	cacheState := "HIT"
+	if err != nil {
+		// expired but in stale-while-revalidate window, serve it and refresh in background
+		cacheState = "STALE"
+		c.queueFill(r, next, cacheHost, cacheKey)
+	}
+
+	// ETag (If-Match, If-None-Match)
+	// Last-Modified (If-Modified-Since, If-Unmodified-Since)
+	if code := checkPreconditions(r, cacheMeta); code != 0 {
+		writeNotModified(w, c.CacheHeaderName, cacheState, cacheMeta, code)
+		return
+	}
+
+	writeCacheResponse(w, r, c.CacheHeaderName, cacheState, cacheMeta, ce, cacheData)
+}
+
+// writeCacheResponse writes the cached entry to client, without body for HEAD request
+func writeCacheResponse(w http.ResponseWriter, r *http.Request, cacheHeaderName string, cacheState string, cacheMeta *CacheMeta, ce string, cacheData []byte) {
+	hdr := w.Header()
+	hdr.Set(cacheHeaderName, cacheState)
+	hdr.Set("Vary", mergeVary(cacheMeta.Vary))
+	if ce != "none" {
+		hdr.Set("Content-Encoding", ce)
+	}
+	// set header back
+	cacheMeta.CopyHeader(hdr)
+	status := cacheMeta.StateCode
+	if status == http.StatusOK {
+		hdr.Set("Accept-Ranges", "bytes")
+		status, cacheData = applyRange(r, hdr, cacheMeta, cacheData)
+	}
+	// meta on disk may come from another encoding
+	hdr.Set("Content-Length", strconv.Itoa(len(cacheData)))
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		w.Write(cacheData)
+	}
+}
+
+// lookup tries the key with every encoding in order, encodings must not be empty.
+// The variant index in memory goes to the variant directly, the one on disk is only checked
+// when nothing found, so pages without Vary still cost one lookup.
+// A hit not in the preferred encoding queues the missing encodings to be derived,
+// they may be dropped by a full queue, evicted or never compressed before restart.
+func (c *Cache) lookup(r *http.Request, host string, key string, encodings []string) ([]byte, *CacheMeta, string, error) {
+	db := c.Store
+	// taken before the entry read, derived from it are dropped if purged after
+	gen := db.Generation(host)
 	var cacheData []byte
 	var cacheMeta *CacheMeta
 	var err error
 	ce := ""
-	for _, re := range requestEncoding {
-		ce = strings.TrimSpace(re)
-		cacheData, cacheMeta, err = db.Get(cacheKey, ce)
-		if err == nil {
-			break
-		}
+
+	// expired entry for stale-if-error
+	var expired *MemCacheItem
+	expiredCE := ""
+
+	varied := false
+	if vary := db.PeekVary(host, key); len(vary) > 0 {
+		key = variantKey(key, vary, r.Header)
+		varied = true
 	}
-	if err == nil {
-		// TODO: some limit prevent self-DoS
-		if ce == "none" && requestEncoding[0] != "none" {
-			go c.doCache(r, next)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			if varied {
+				break
+			}
+			vary := db.GetVary(host, key)
+			if len(vary) == 0 {
+				break
+			}
+			key = variantKey(key, vary, r.Header)
 		}
 
-		// TODO: implement 304 Not Modified reponse for
-		// ETag (If-Match, If-None-Match)
-		// Last-Modified (If-Modified-Since, If-Unmodified-Since)
-
-		hdr.Set(c.CacheHeaderName, "HIT")
-		hdr.Set("Vary", "Accept-Encoding")
-		if ce != "none" {
-			hdr.Set("Content-Encoding", ce)
+		for _, ce = range encodings {
+			cacheData, cacheMeta, err = db.Get(host, key, ce)
+			if err == nil && ce != encodings[0] && c.StoreEncoding == "" {
+				db.queueEncode(host, key, ce, gen, cacheMeta, cacheData)
+			}
+			if err == nil || errors.Is(err, ErrCacheStale) {
+				return cacheData, cacheMeta, ce, err
+			}
+			if errors.Is(err, ErrCacheExpired) && cacheData != nil && expired == nil {
+				expired = &MemCacheItem{
+					CacheMeta: cacheMeta,
+					value:     cacheData,
+				}
+				expiredCE = ce
+			}
 		}
-		// set header back
-		for _, kv := range cacheMeta.Header {
-			if len(kv) != 2 {
-				continue
+
+		// only one encoding stored, convert it to the one client accepts
+		if c.StoreEncoding != "" && expired == nil {
+			ce = encodings[0]
+			cacheData, cacheMeta, err = db.GetTranscoded(host, key, c.StoreEncoding, ce)
+			if err == nil || errors.Is(err, ErrCacheStale) {
+				return cacheData, cacheMeta, ce, err
+			}
+			if errors.Is(err, ErrCacheExpired) && cacheData != nil {
+				expired = &MemCacheItem{
+					CacheMeta: cacheMeta,
+					value:     cacheData,
+				}
+				expiredCE = ce
 			}
-			hdr.Set(kv[0], kv[1])
 		}
-		w.WriteHeader(cacheMeta.StateCode)
-		w.Write(cacheData)
+	}
+	if expired != nil {
+		return expired.value, expired.CacheMeta, expiredCE, ErrCacheExpired
+	}
+	return nil, nil, "", err
+}
 
-		return nil
+// Cleanup stops the store and fill workers when config unloaded
+func (c *Cache) Cleanup() error {
+	if c.fills != nil {
+		c.fills.Close()
 	}
-	c.logger.Debug("wp cache - error - "+cacheKey, zap.Error(err))
+	if c.Store != nil {
+		c.Store.Close()
+	}
+	return nil
+}
 
-	nw := NewCustomWriter(w, r, db, c.logger, c)
-	defer nw.Close()
-	return next.ServeHTTP(nw, r)
+// queueFill refreshes or fills the key in background,
+// only one fill queued or running for the same key at a time
+func (c *Cache) queueFill(r *http.Request, next caddyhttp.Handler, cacheHost string, cacheKey string) {
+	c.fills.Push(&fillJob{
+		id:        fillID(cacheHost, cacheKey),
+		r:         r.Clone(context.Background()),
+		next:      next,
+		cacheHost: cacheHost,
+		cacheKey:  cacheKey,
+	})
 }
 
-func (c *Cache) doCache(r0 *http.Request, next caddyhttp.Handler) {
-	r := r0.Clone(context.Background())
+// doCache runs backend for the key, ctx ends the request to backend
+func (c *Cache) doCache(ctx context.Context, r0 *http.Request, next caddyhttp.Handler, cacheHost string, cacheKey string) {
+	r := r0.Clone(ctx)
 	repl := caddy.NewReplacer()
 	r = caddyhttp.PrepareRequest(r, repl, nil, nil)
+	// may be triggered by HEAD request
+	r.Method = "GET"
+	// need full response from backend to fill the cache
+	for _, key := range hdrReqFillStripList {
+		r.Header.Del(key)
+	}
 	c.logger.Debug("wp cache - preload - ", zap.String("path", r.URL.Path))
 	db := c.Store
 	w := &NopResponseWriter{}
-	nw := NewCustomWriter(w, r, db, c.logger, c)
+	nw := NewCustomWriter(w, r, db, c.logger, c, cacheHost, cacheKey)
 	defer nw.Close()
-	next.ServeHTTP(nw, r)
+	err := next.ServeHTTP(nw, r)
+	// cut by timeout or Close, the body may be partial
+	if err != nil || ctx.Err() != nil {
+		atomic.StoreInt32(&nw.needCache, 0)
+	}
 }
 
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*Cache)(nil)
+	_ caddy.CleanerUpper          = (*Cache)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Cache)(nil)
 	_ caddyfile.Unmarshaler       = (*Cache)(nil)
 	// _ caddy.Validator             = (*Cache)(nil)
@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// parseCacheControl returns Cache-Control directives with lower case name,
+// quotes of value are removed
+func parseCacheControl(hdr http.Header) map[string]string {
+	cc := make(map[string]string)
+	for _, line := range hdr.Values("Cache-Control") {
+		for _, directive := range strings.Split(line, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+// uncacheableReason checks whether a shared cache may store the response (RFC 9111 section 3),
+// returns the reason if not, empty if cacheable.
+func (r *CustomWriter) uncacheableReason(hdr http.Header) string {
+	cc := parseCacheControl(hdr)
+	if !r.ignoreCacheControl {
+		if _, ok := cc["no-store"]; ok {
+			return "cache-control no-store"
+		}
+		// `private="Set-Cookie"` only forbid these fields, but keep it simple
+		if _, ok := cc["private"]; ok {
+			return "cache-control private"
+		}
+		// no way to revalidate, `no-cache="Set-Cookie"` with field names can still be stored
+		if v, ok := cc["no-cache"]; ok && v == "" {
+			return "cache-control no-cache"
+		}
+		if len(cc) == 0 && strings.Contains(strings.ToLower(hdr.Get("Pragma")), "no-cache") {
+			return "pragma no-cache"
+		}
+	}
+
+	// response to authorized request only stored if explicitly allowed,
+	// checked even with cache-control ignored, or the page of one user is served to all
+	if r.Request.Header.Get("Authorization") != "" {
+		_, public := cc["public"]
+		_, sMaxAge := cc["s-maxage"]
+		_, mustRevalidate := cc["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return "authorization"
+		}
+	}
+
+	// Set-Cookie never stored (not in hdrResCacheList), but the cookie may belong to the session
+	if !r.ignoreSetCookie && len(hdr.Values("Set-Cookie")) > 0 {
+		return "set-cookie"
+	}
+	return ""
+}
+
+// freshnessLifetime returns the lifetime in seconds the response says (RFC 9111 section 4.2.1),
+// from s-maxage, max-age or Expires, minus Age.
+// ok is false if the response has none of them.
+func freshnessLifetime(hdr http.Header) (lifetime int, ok bool) {
+	cc := parseCacheControl(hdr)
+	if v, found := cc["s-maxage"]; found {
+		lifetime, ok = parseDeltaSeconds(v), true
+	} else if v, found := cc["max-age"]; found {
+		lifetime, ok = parseDeltaSeconds(v), true
+	} else if expires := hdr.Get("Expires"); expires != "" {
+		ok = true
+		// invalid Expires means already expired
+		if t, err := http.ParseTime(expires); err == nil {
+			date, err := http.ParseTime(hdr.Get("Date"))
+			if err != nil {
+				date = time.Now()
+			}
+			lifetime = int(t.Sub(date) / time.Second)
+		}
+	}
+	if !ok {
+		return 0, false
+	}
+
+	if age := parseDeltaSeconds(hdr.Get("Age")); age > 0 {
+		lifetime -= age
+	}
+	return max(lifetime, 0), true
+}
+
+// parseDeltaSeconds returns 0 for invalid value
+func parseDeltaSeconds(v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// decideTTL returns the TTL stored in CacheMeta, the lifetime from response clamped by ttl_min and ttl_max,
+// or the first matched ttl_rules / global ttl if the response has no lifetime, -1 means never expire.
+// 0 means the response is already stale and should not be stored.
+func (r *CustomWriter) decideTTL(hdr http.Header) int {
+	if !r.ignoreCacheControl {
+		if lifetime, ok := freshnessLifetime(hdr); ok {
+			if r.ttlMin > 0 && lifetime < r.ttlMin {
+				lifetime = r.ttlMin
+			}
+			if r.ttlMax > 0 && lifetime > r.ttlMax {
+				lifetime = r.ttlMax
+			}
+			return lifetime
+		}
+	}
+
+	ttl := r.ttl
+	status := int(atomic.LoadInt32(&r.status))
+	for _, rule := range r.ttlRules {
+		if rule.Match(r.Request, status) {
+			ttl = rule.TTL
+			break
+		}
+	}
+
+	if ttl <= 0 {
+		return -1
+	}
+	return ttl
+}
+
+// decideStaleTTL returns the stale-while-revalidate window of the response,
+// or stale_while_revalidate from config if the response has none
+func (r *CustomWriter) decideStaleTTL(hdr http.Header) int {
+	if !r.ignoreCacheControl {
+		if v, ok := parseCacheControl(hdr)["stale-while-revalidate"]; ok {
+			return parseDeltaSeconds(v)
+		}
+	}
+	return max(r.staleTTL, 0)
+}
+
+// decideStaleErrorTTL returns the stale-if-error window of the response,
+// or stale_if_error from config if the response has none
+func (r *CustomWriter) decideStaleErrorTTL(hdr http.Header) int {
+	if !r.ignoreCacheControl {
+		if v, ok := parseCacheControl(hdr)["stale-if-error"]; ok {
+			return parseDeltaSeconds(v)
+		}
+	}
+	return max(r.staleErrorTTL, 0)
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUncacheableReason(t *testing.T) {
+	tests := []struct {
+		name            string
+		hdr             http.Header
+		authorization   bool
+		ignoreCC        bool
+		ignoreSetCookie bool
+		want            string
+	}{
+		{"plain", http.Header{}, false, false, false, ""},
+		{"public max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, false, false, false, ""},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false, false, false, "cache-control no-store"},
+		{"no-store upper case", http.Header{"Cache-Control": {"max-age=60, No-Store"}}, false, false, false, "cache-control no-store"},
+		{"no-store on second line", http.Header{"Cache-Control": {"max-age=60", "no-store"}}, false, false, false, "cache-control no-store"},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, false, false, false, "cache-control private"},
+		{"private with fields", http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false, false, false, "cache-control private"},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, false, false, false, "cache-control no-cache"},
+		{"no-cache with fields", http.Header{"Cache-Control": {`no-cache="Set-Cookie"`}}, false, false, false, ""},
+		{"pragma no-cache", http.Header{"Pragma": {"no-cache"}}, false, false, false, "pragma no-cache"},
+		{"pragma ignored with cache-control", http.Header{"Pragma": {"no-cache"}, "Cache-Control": {"max-age=60"}}, false, false, false, ""},
+		{"set-cookie", http.Header{"Set-Cookie": {"a=b"}}, false, false, false, "set-cookie"},
+		{"set-cookie ignored", http.Header{"Set-Cookie": {"a=b"}}, false, false, true, ""},
+		{"authorization", http.Header{}, true, false, false, "authorization"},
+		{"authorization public", http.Header{"Cache-Control": {"public"}}, true, false, false, ""},
+		{"authorization s-maxage", http.Header{"Cache-Control": {"s-maxage=60"}}, true, false, false, ""},
+		{"authorization must-revalidate", http.Header{"Cache-Control": {"must-revalidate"}}, true, false, false, ""},
+		{"ignore cache-control", http.Header{"Cache-Control": {"no-store, private"}, "Pragma": {"no-cache"}}, false, true, false, ""},
+		{"ignore cache-control keeps authorization", http.Header{"Cache-Control": {"no-store, private"}, "Pragma": {"no-cache"}}, true, true, false, "authorization"},
+		{"ignore cache-control authorization public", http.Header{"Cache-Control": {"public"}}, true, true, false, ""},
+		{"ignore cache-control keeps set-cookie", http.Header{"Cache-Control": {"no-store"}, "Set-Cookie": {"a=b"}}, false, true, false, "set-cookie"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization {
+				r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+			}
+			w := &CustomWriter{Request: r, ignoreCacheControl: tt.ignoreCC, ignoreSetCookie: tt.ignoreSetCookie}
+			if got := w.uncacheableReason(tt.hdr); got != tt.want {
+				t.Errorf("uncacheableReason() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	const date = "Tue, 01 Oct 2024 10:00:00 GMT"
+	tests := []struct {
+		name     string
+		hdr      http.Header
+		lifetime int
+		ok       bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"age only", http.Header{"Age": {"10"}}, 0, false},
+		{"max-age", http.Header{"Cache-Control": {"max-age=30"}}, 30, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=10, s-maxage=60"}}, 60, true},
+		{"quoted", http.Header{"Cache-Control": {`max-age="30"`}}, 30, true},
+		{"invalid max-age is stale", http.Header{"Cache-Control": {"max-age=abc"}}, 0, true},
+		{"negative max-age is stale", http.Header{"Cache-Control": {"max-age=-1"}}, 0, true},
+		{"max-age wins over expires", http.Header{"Cache-Control": {"max-age=30"}, "Date": {date}, "Expires": {"Tue, 01 Oct 2024 11:00:00 GMT"}}, 30, true},
+		{"expires with date", http.Header{"Date": {date}, "Expires": {"Tue, 01 Oct 2024 10:02:00 GMT"}}, 120, true},
+		{"expires before date", http.Header{"Date": {date}, "Expires": {"Tue, 01 Oct 2024 09:00:00 GMT"}}, 0, true},
+		{"invalid expires is stale", http.Header{"Date": {date}, "Expires": {"0"}}, 0, true},
+		{"expires with age", http.Header{"Date": {date}, "Expires": {"Tue, 01 Oct 2024 10:02:00 GMT"}, "Age": {"20"}}, 100, true},
+		{"age", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, 40, true},
+		{"age older than lifetime", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, 0, true},
+		{"invalid age ignored", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"abc"}}, 60, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lifetime, ok := freshnessLifetime(tt.hdr)
+			if lifetime != tt.lifetime || ok != tt.ok {
+				t.Errorf("freshnessLifetime() = %v %v, want %v %v", lifetime, ok, tt.lifetime, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFreshnessLifetimeWithoutDate(t *testing.T) {
+	hdr := http.Header{"Expires": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}
+	lifetime, ok := freshnessLifetime(hdr)
+	if !ok || lifetime < 3590 || lifetime > 3600 {
+		t.Errorf("freshnessLifetime() = %v %v, want about 3600", lifetime, ok)
+	}
+}
+
+func TestDecideTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		hdr      http.Header
+		ttl      int
+		ttlMin   int
+		ttlMax   int
+		ignoreCC bool
+		want     int
+	}{
+		{"from response", http.Header{"Cache-Control": {"max-age=60"}}, 600, 0, 0, false, 60},
+		{"clamped by min", http.Header{"Cache-Control": {"max-age=5"}}, 600, 30, 0, false, 30},
+		{"clamped by max", http.Header{"Cache-Control": {"max-age=9000"}}, 600, 0, 3600, false, 3600},
+		{"stale response raised by min", http.Header{"Cache-Control": {"max-age=0"}}, 600, 30, 0, false, 30},
+		{"stale response not stored", http.Header{"Cache-Control": {"max-age=0"}}, 600, 0, 0, false, 0},
+		{"global fallback", http.Header{}, 600, 30, 60, false, 600},
+		{"ignore cache-control", http.Header{"Cache-Control": {"max-age=60"}}, 600, 0, 0, true, 600},
+		{"never expire", http.Header{}, 0, 0, 0, false, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &CustomWriter{
+				Request:            httptest.NewRequest(http.MethodGet, "/", nil),
+				ttl:                tt.ttl,
+				ttlMin:             tt.ttlMin,
+				ttlMax:             tt.ttlMax,
+				ignoreCacheControl: tt.ignoreCC,
+			}
+			if got := w.decideTTL(tt.hdr); got != tt.want {
+				t.Errorf("decideTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// seconds a key skips coalescing after its response was not cacheable
+	PASS_TTL = 30
+
+	// keys remembered as not cacheable, the oldest ones are dropped
+	PASS_MAX_KEYS = 4096
+)
+
+// fillCall is a backend request filling the cache of a key,
+// other requests of the same key wait for it instead of running backend again
+type fillCall struct {
+	done chan struct{}
+
+	// the response stored, set before done closed
+	stored bool
+}
+
+// fillID returns the id of a key for queued and coalesced fills
+func fillID(host string, key string) string {
+	return hostDir(host) + "/" + key
+}
+
+// joinFill returns the fill in progress of the key,
+// leader is true if the caller should run backend and call finishFill after.
+// Keys not cacheable recently are never coalesced (hit-for-pass),
+// waiting only makes the requests run backend one after another.
+func (c *Cache) joinFill(id string) (call *fillCall, leader bool) {
+	if c.CoalesceTimeout < 0 || c.isPass(id) {
+		return nil, true
+	}
+	// not LoadOrCompute, it may store another value than the returned one
+	call, loaded := c.filling.LoadOrStore(id, &fillCall{done: make(chan struct{})})
+	return call, !loaded
+}
+
+// finishFill wakes up the requests waiting for the fill
+func (c *Cache) finishFill(id string, call *fillCall, stored bool) {
+	if call == nil {
+		return
+	}
+	call.stored = stored
+	c.filling.Delete(id)
+	close(call.done)
+}
+
+// waitFill waits until the fill done or timeout,
+// reports whether the leader stored the response, so the cache can be used.
+func (c *Cache) waitFill(r *http.Request, call *fillCall) bool {
+	timer := time.NewTimer(time.Duration(c.CoalesceTimeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case <-call.done:
+		return call.stored
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// isPass reports whether the response of the key was not cacheable within PASS_TTL
+func (c *Cache) isPass(id string) bool {
+	expire, ok := c.passing.Peek(id)
+	return ok && time.Now().Unix() < *expire
+}
+
+// recordPass remembers the verdict of a response from backend,
+// uncacheable is false if not stored for other reasons, like error or client gone.
+func (c *Cache) recordPass(id string, stored bool, uncacheable bool) {
+	if stored {
+		c.passing.Delete(id)
+	} else if uncacheable {
+		c.passing.Put(id, time.Now().Unix()+PASS_TTL, 1)
+	}
+}
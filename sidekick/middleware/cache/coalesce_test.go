@@ -0,0 +1,131 @@
+package cache
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// newTestCache returns a provisioned Cache storing in a temp directory
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	c := &Cache{Loc: t.TempDir(), TTL: 60, CacheResponseCodes: []string{"200"}}
+	if err := c.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Cleanup() })
+	// the logger of a context without config is a debug one
+	c.logger = zap.NewNop()
+	c.Store.logger = c.logger
+	c.fills.logger = c.logger
+	return c
+}
+
+// testBackend blocks every request until release closed
+type testBackend struct {
+	calls     atomic.Int32
+	setCookie atomic.Bool
+	release   chan struct{}
+}
+
+func (b *testBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) error {
+	b.calls.Add(1)
+	<-b.release
+	w.Header().Set("Content-Type", "text/html")
+	if b.setCookie.Load() {
+		w.Header().Set("Set-Cookie", "session=1")
+	}
+	w.Write([]byte("page"))
+	return nil
+}
+
+// serveConcurrent runs n requests of the page at once, returns the cache status of each
+func serveConcurrent(t *testing.T, c *Cache, next caddyhttp.Handler, n int) []string {
+	t.Helper()
+	status := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			c.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/page/", nil), next)
+			if w.Body.String() != "page" {
+				t.Errorf("request %v got %q", i, w.Body.String())
+			}
+			status[i] = w.Header().Get(c.CacheHeaderName)
+		}(i)
+	}
+	wg.Wait()
+	return status
+}
+
+func TestCoalesceMisses(t *testing.T) {
+	c := newTestCache(t)
+	b := &testBackend{release: make(chan struct{})}
+
+	done := make(chan []string)
+	go func() { done <- serveConcurrent(t, c, b, 5) }()
+	// the leader is in backend, others wait for it
+	waitFor(t, "leader", func() bool { return b.calls.Load() == 1 })
+	waitFor(t, "waiters", func() bool { return c.filling.Size() == 1 })
+	close(b.release)
+
+	status := <-done
+	if n := b.calls.Load(); n != 1 {
+		t.Errorf("backend called %v times", n)
+	}
+	hits := 0
+	for _, s := range status {
+		if s == "HIT" {
+			hits++
+		}
+	}
+	if hits != 4 {
+		t.Errorf("status = %v, want 1 MISS and 4 HIT", status)
+	}
+}
+
+func TestCoalesceSkipsUncacheable(t *testing.T) {
+	c := newTestCache(t)
+	b := &testBackend{release: make(chan struct{})}
+	b.setCookie.Store(true)
+	fid := fillID("example.com", c.buildRequestKey(httptest.NewRequest("GET", "http://example.com/page/", nil)))
+
+	// not cached by the leader, waiters run backend by themselves
+	done := make(chan []string)
+	go func() { done <- serveConcurrent(t, c, b, 3) }()
+	waitFor(t, "leader", func() bool { return b.calls.Load() == 1 })
+	close(b.release)
+	<-done
+	if n := b.calls.Load(); n != 3 {
+		t.Errorf("backend called %v times, want 3", n)
+	}
+	if !c.isPass(fid) {
+		t.Fatal("uncacheable page not remembered")
+	}
+
+	// hit-for-pass, all run backend at once instead of waiting for each other
+	b.calls.Store(0)
+	b.release = make(chan struct{})
+	go func() { done <- serveConcurrent(t, c, b, 3) }()
+	waitFor(t, "requests in backend at once", func() bool { return b.calls.Load() == 3 })
+	close(b.release)
+	<-done
+
+	// cacheable again, coalesced again
+	b.setCookie.Store(false)
+	serveConcurrent(t, c, b, 1)
+	if c.isPass(fid) {
+		t.Error("still pass after stored")
+	}
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// request headers may make backend response 206/304/412 instead of full content
+var hdrReqFillStripList = []string{
+	"Range",
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// headers should be sent with 304 Not Modified if 200 would send them (RFC 9110 section 15.4.5)
+var hdrNotModifiedList = []string{
+	"Etag",
+	"Last-Modified",
+	"Expires",
+	"Cache-Control",
+	"Content-Location",
+}
+
+// checkPreconditions evaluates the conditional headers of a GET request
+// against the cached entry in the order of RFC 9110 section 13.2.2,
+// returns 304 or 412 if the full response should not be sent, otherwise 0.
+func checkPreconditions(r *http.Request, meta *CacheMeta) int {
+	// preconditions are ignored if the response would not be 2xx
+	if meta.StateCode < 200 || meta.StateCode > 299 {
+		return 0
+	}
+	etag := meta.GetHeader("Etag")
+	lastModified := meta.GetHeader("Last-Modified")
+
+	// step 1 & 2
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !matchETag(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" {
+		if modified, ok := isModifiedSince(lastModified, ius); ok && modified {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	// step 3 & 4, only GET can be cached so always 304
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if matchETag(inm, etag, true) {
+			return http.StatusNotModified
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if modified, ok := isModifiedSince(lastModified, ims); ok && !modified {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// writeNotModified writes 304 or 412 response with validators of the cached entry
+func writeNotModified(w http.ResponseWriter, cacheHeaderName string, cacheState string, cacheMeta *CacheMeta, code int) {
+	hdr := w.Header()
+	hdr.Set(cacheHeaderName, cacheState)
+	if code == http.StatusNotModified {
+		hdr.Set("Vary", mergeVary(cacheMeta.Vary))
+		cacheMeta.CopyHeader(hdr, hdrNotModifiedList...)
+	}
+	w.WriteHeader(code)
+}
+
+// contentETag returns a strong entity-tag derived from the stored body,
+// encoding is appended so each compressed variant has its own tag.
+func contentETag(body []byte, ce string) string {
+	sum := sha256.Sum256(body)
+	tag := hex.EncodeToString(sum[:16])
+	if ce != "" && ce != "none" {
+		tag += "-" + ce
+	}
+	return `"` + tag + `"`
+}
+
+// matchETag reports whether etag matches any entity-tag in the list,
+// `*` matches any current representation, even without entity-tag.
+// weak comparison for If-None-Match, strong comparison for If-Match.
+func matchETag(list string, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return false
+		}
+		tag, rest := scanETag(list)
+		if tag == "" {
+			// malformed, skip to next one
+			_, rest, _ = strings.Cut(list, ",")
+		} else if weak && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		} else if !weak && !strings.HasPrefix(tag, "W/") && !strings.HasPrefix(etag, "W/") && tag == etag {
+			return true
+		}
+		list = rest
+	}
+}
+
+// scanETag returns the first entity-tag in s and the remaining string,
+// tag is empty if s does not start with a valid entity-tag.
+func scanETag(s string) (string, string) {
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s)-start < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag chars can not contain quote, so the next quote closes the tag
+	end := strings.IndexByte(s[start+1:], '"')
+	if end < 0 {
+		return "", ""
+	}
+	end += start + 2
+	return s[:end], s[end:]
+}
+
+// isModifiedSince reports whether lastModified is later than the date,
+// ok is false if either one is missing or invalid, then the condition should be ignored.
+func isModifiedSince(lastModified string, date string) (modified bool, ok bool) {
+	if lastModified == "" {
+		return false, false
+	}
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return false, false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false, false
+	}
+	return lm.Truncate(time.Second).After(t), true
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMatchETag(t *testing.T) {
+	tests := []struct {
+		list string
+		etag string
+		weak bool
+		want bool
+	}{
+		{`*`, `"a"`, false, true},
+		{`*`, ``, false, true},
+		{` * `, ``, true, true},
+		{`"a"`, ``, true, false},
+		{`"a"`, `"a"`, false, true},
+		{`"a"`, `"b"`, false, false},
+		{`"b", "a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`"a"`, `W/"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`bad, "a"`, `"a"`, true, true},
+		{`"unclosed`, `"a"`, true, false},
+		{``, `"a"`, true, false},
+	}
+	for _, tt := range tests {
+		if got := matchETag(tt.list, tt.etag, tt.weak); got != tt.want {
+			t.Errorf("matchETag(%q, %q, %v) = %v, want %v", tt.list, tt.etag, tt.weak, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	const (
+		etag    = `"v1"`
+		lm      = "Tue, 01 Oct 2024 10:00:00 GMT"
+		before  = "Mon, 30 Sep 2024 10:00:00 GMT"
+		after   = "Wed, 02 Oct 2024 10:00:00 GMT"
+		invalid = "yesterday"
+	)
+	meta := &CacheMeta{StateCode: 200, Header: [][]string{{"Etag", etag}, {"Last-Modified", lm}}}
+	noValidator := &CacheMeta{StateCode: 200}
+	notFound := &CacheMeta{StateCode: 404, Header: [][]string{{"Etag", etag}}}
+
+	tests := []struct {
+		name string
+		meta *CacheMeta
+		hdr  map[string]string
+		want int
+	}{
+		{"no condition", meta, nil, 0},
+		{"if-match hit", meta, map[string]string{"If-Match": etag}, 0},
+		{"if-match miss", meta, map[string]string{"If-Match": `"v0"`}, http.StatusPreconditionFailed},
+		{"if-match weak is not strong match", meta, map[string]string{"If-Match": `W/"v1"`}, http.StatusPreconditionFailed},
+		{"if-match star", meta, map[string]string{"If-Match": "*"}, 0},
+		{"if-match star without etag", noValidator, map[string]string{"If-Match": "*"}, 0},
+		{"if-unmodified-since passed", meta, map[string]string{"If-Unmodified-Since": after}, 0},
+		{"if-unmodified-since failed", meta, map[string]string{"If-Unmodified-Since": before}, http.StatusPreconditionFailed},
+		{"if-unmodified-since invalid ignored", meta, map[string]string{"If-Unmodified-Since": invalid}, 0},
+		{"if-match wins over if-unmodified-since", meta, map[string]string{"If-Match": etag, "If-Unmodified-Since": before}, 0},
+		{"if-none-match hit", meta, map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"if-none-match weak hit", meta, map[string]string{"If-None-Match": `W/"v1"`}, http.StatusNotModified},
+		{"if-none-match miss", meta, map[string]string{"If-None-Match": `"v0"`}, 0},
+		{"if-none-match star", meta, map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"if-modified-since not modified", meta, map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"if-modified-since same second", meta, map[string]string{"If-Modified-Since": lm}, http.StatusNotModified},
+		{"if-modified-since modified", meta, map[string]string{"If-Modified-Since": before}, 0},
+		{"if-modified-since invalid ignored", meta, map[string]string{"If-Modified-Since": invalid}, 0},
+		{"if-modified-since without last-modified", noValidator, map[string]string{"If-Modified-Since": after}, 0},
+		{"if-none-match wins over if-modified-since", meta, map[string]string{"If-None-Match": `"v0"`, "If-Modified-Since": after}, 0},
+		{"412 before 304", meta, map[string]string{"If-Match": `"v0"`, "If-None-Match": etag}, http.StatusPreconditionFailed},
+		{"ignored for non 2xx", notFound, map[string]string{"If-None-Match": etag}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range tt.hdr {
+				r.Header.Set(k, v)
+			}
+			if got := checkPreconditions(r, tt.meta); got != tt.want {
+				t.Errorf("checkPreconditions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteNotModified(t *testing.T) {
+	meta := &CacheMeta{
+		StateCode: 200,
+		Header:    [][]string{{"Etag", `"v1"`}, {"Content-Type", "text/html"}, {"Cache-Control", "max-age=60"}},
+		Vary:      []string{"Accept-Language"},
+	}
+	w := httptest.NewRecorder()
+	writeNotModified(w, "X-Cache", "HIT", meta, http.StatusNotModified)
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("code = %v", w.Code)
+	}
+	hdr := w.Header()
+	if hdr.Get("Etag") != `"v1"` || hdr.Get("Cache-Control") != "max-age=60" || hdr.Get("X-Cache") != "HIT" {
+		t.Errorf("validators missing: %v", hdr)
+	}
+	if hdr.Get("Content-Type") != "" {
+		t.Errorf("Content-Type should not be sent with 304: %v", hdr)
+	}
+	if hdr.Get("Vary") == "" {
+		t.Errorf("Vary missing: %v", hdr)
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	body := []byte("hello")
+	plain := contentETag(body, "none")
+	if plain != contentETag(body, "") {
+		t.Errorf("identity tag differs: %v", plain)
+	}
+	if gz := contentETag(body, "gzip"); gz == plain || gz[len(gz)-6:] != `-gzip"` {
+		t.Errorf("gzip tag = %v", gz)
+	}
+	if plain == contentETag([]byte("hello!"), "none") {
+		t.Errorf("different bodies share tag")
+	}
+}
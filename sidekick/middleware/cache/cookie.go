@@ -0,0 +1,66 @@
+package cache
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// skip cache for logged in users, cart, commenters and password protected posts
+var defaultBypassCookies = []string{
+	"wordpress_logged_in",
+	"woocommerce_items_in_cart",
+	"wp_woocommerce_session_",
+	"comment_author_",
+	"wp-postpass_",
+}
+
+// cookieMatcher matches cookie names by prefix, or by regex if the item starts with `~`
+type cookieMatcher struct {
+	prefixes []string
+	rxs      []*regexp.Regexp
+}
+
+func newCookieMatcher(list []string) (*cookieMatcher, error) {
+	m := &cookieMatcher{}
+	for _, item := range list {
+		if expr, ok := strings.CutPrefix(item, "~"); ok {
+			rx, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, err
+			}
+			m.rxs = append(m.rxs, rx)
+			continue
+		}
+		m.prefixes = append(m.prefixes, item)
+	}
+	return m, nil
+}
+
+func (m *cookieMatcher) Match(name string) bool {
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for _, rx := range m.rxs {
+		if rx.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// varyCookies returns `name=value` of matched cookies sorted by name,
+// which split the cache instead of bypass it
+func (m *cookieMatcher) varyCookies(cookies []*http.Cookie) []string {
+	var list []string
+	for _, cookie := range cookies {
+		if m.Match(cookie.Name) {
+			list = append(list, cookie.Name+"="+cookie.Value)
+		}
+	}
+	slices.Sort(list)
+	return list
+}
@@ -0,0 +1,281 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+const (
+	// background workers to derive encodings of bodies from backend
+	ENCODE_WORKERS = 2
+
+	// pending bodies to compress, new ones are dropped if full
+	ENCODE_QUEUE_SIZE = 256
+
+	// too small to worth compress
+	ENCODE_MIN_SIZE = 256
+)
+
+type encodeJob struct {
+	host  string
+	key   string
+	ce    string
+	gen   uint64
+	meta  *CacheMeta
+	value []byte
+}
+
+// encoder holds reusable compressors
+type encoder struct {
+	gzipLevel int
+	brLevel   int
+	zstd      *zstd.Encoder
+}
+
+// newEncoder returns encoder at best compression for background worker,
+// or default level for on the fly transcoding
+func newEncoder(best bool) *encoder {
+	if !best {
+		// only error on invalid options
+		enc, _ := zstd.NewWriter(nil)
+		return &encoder{
+			gzipLevel: gzip.DefaultCompression,
+			brLevel:   brotli.DefaultCompression,
+			zstd:      enc,
+		}
+	}
+	enc, _ := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedBestCompression),
+		zstd.WithEncoderConcurrency(1),
+	)
+	return &encoder{
+		gzipLevel: gzip.BestCompression,
+		brLevel:   brotli.BestCompression,
+		zstd:      enc,
+	}
+}
+
+var (
+	// shared by requests, EncodeAll and DecodeAll are safe for concurrent use
+	fastEncoder = sync.OnceValue(func() *encoder {
+		return newEncoder(false)
+	})
+	zstdDecoder = sync.OnceValue(func() *zstd.Decoder {
+		dec, _ := zstd.NewReader(nil)
+		return dec
+	})
+)
+
+// Encode compresses body with the content encoding
+func (e *encoder) Encode(ce string, body []byte) ([]byte, error) {
+	switch ce {
+	case "none":
+		return body, nil
+	case "zstd":
+		return e.zstd.EncodeAll(body, make([]byte, 0, len(body)/2)), nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(body) / 2)
+	switch ce {
+	case "gzip":
+		w, _ := gzip.NewWriterLevel(&buf, e.gzipLevel)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		w := brotli.NewWriterLevel(&buf, e.brLevel)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// decode returns the identity body of the compressed one
+func decode(ce string, body []byte) ([]byte, error) {
+	var rd io.Reader
+	switch ce {
+	case "none":
+		return body, nil
+	case "zstd":
+		return zstdDecoder().DecodeAll(body, nil)
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		rd = gr
+	case "br":
+		rd = brotli.NewReader(bytes.NewReader(body))
+	}
+	return io.ReadAll(rd)
+}
+
+// transcode converts the body from one content encoding to another
+func transcode(from string, to string, body []byte) ([]byte, error) {
+	identity, err := decode(from, body)
+	if err != nil {
+		return nil, err
+	}
+	return fastEncoder().Encode(to, identity)
+}
+
+// compressible reports whether the content type worth compress,
+// media and archives are already compressed
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	if contentType == "" || strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, s := range []string{"json", "javascript", "xml", "svg", "wasm"} {
+		if strings.Contains(contentType, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// queueEncode adds the body from backend to be converted to other encodings in background.
+// Every missing encoding is derived from it, compressed bodies are decoded first,
+// or only the one to be stored, other stored encoding is converted to it.
+// A body already queued is skipped, so hits can retry the missing encodings cheaply.
+func (d *Store) queueEncode(host string, key string, ce string, gen uint64, meta *CacheMeta, value []byte) {
+	if d.storeEncoding == ce {
+		return
+	}
+	if ce == "none" && (len(value) < ENCODE_MIN_SIZE || !compressible(meta.GetHeader("Content-Type"))) {
+		return
+	}
+	id := memKey(host, key, ce)
+	if pending, loaded := d.encodePending.LoadAndStore(id, meta); loaded && pending == meta {
+		return
+	}
+	select {
+	case d.encodeQueue <- &encodeJob{host: host, key: key, ce: ce, gen: gen, meta: meta, value: value}:
+	default:
+		d.encodePending.Delete(id)
+		// log some of them, warm up may drop a lot
+		if n := d.encodeDropped.Add(1); n == 1 || n%100 == 0 {
+			d.logger.Warn("wp cache - encode queue full, skip compress", zap.String("host", host), zap.String("key", key), zap.Int64("dropped", n))
+		}
+	}
+}
+
+func (d *Store) encodeWorker() {
+	defer d.wg.Done()
+	enc := newEncoder(true)
+	defer enc.zstd.Close()
+	for {
+		select {
+		case <-d.done:
+			return
+		case job := <-d.encodeQueue:
+			d.encode(enc, job)
+			id := memKey(job.host, job.key, job.ce)
+			if pending, ok := d.encodePending.Load(id); ok && pending == job.meta {
+				d.encodePending.Delete(id)
+			}
+		}
+	}
+}
+
+// encode stores every missing variant of the body,
+// or only the encoding to be stored and removes the source one
+func (d *Store) encode(enc *encoder, job *encodeJob) {
+	targets := []string{d.storeEncoding}
+	if d.storeEncoding == "" {
+		targets = make([]string, 0, len(CachedContentEncoding))
+		for _, ce := range CachedContentEncoding {
+			if ce != job.ce && !d.hasVariant(job.host, job.key, ce) {
+				targets = append(targets, ce)
+			}
+		}
+		if len(targets) == 0 {
+			return
+		}
+	}
+
+	identity, err := decode(job.ce, job.value)
+	if err != nil {
+		d.logger.Error("Error decompressing cache", zap.String("key", job.key), zap.String("ce", job.ce), zap.Error(err))
+		return
+	}
+
+	for _, ce := range targets {
+		// replaced or removed while waiting or compressing, the newer one has its own job
+		if !d.isCurrent(job) {
+			return
+		}
+
+		value, err := enc.Encode(ce, identity)
+		if err != nil {
+			d.logger.Error("Error compressing cache", zap.String("key", job.key), zap.String("ce", ce), zap.Error(err))
+			return
+		}
+		if d.Set(job.host, job.key, job.gen, job.meta.derive(ce, value), value) != nil {
+			return
+		}
+	}
+
+	if d.storeEncoding != "" {
+		d.remove(job.host, job.key, job.ce)
+	}
+}
+
+// hasVariant reports whether the encoding of the key is in memory or on disk,
+// variants of an older body are removed when the new one stored, so any one found is current
+func (d *Store) hasVariant(host string, key string, ce string) bool {
+	if _, ok := d.getMemCache().Peek(memKey(host, key, ce)); ok {
+		return true
+	}
+	_, err := os.Stat(metaPath(d.entryPath(host, key), ce))
+	return err == nil
+}
+
+func (d *Store) isCurrent(job *encodeJob) bool {
+	return d.isSource(job.host, job.key, job.meta)
+}
+
+// isSource reports whether meta is still the one in memory of its encoding
+func (d *Store) isSource(host string, key string, meta *CacheMeta) bool {
+	item, ok := d.getMemCache().Peek(memKey(host, key, meta.contentEncoding))
+	return ok && (*item).CacheMeta == meta
+}
+
+// derive returns a copy of the meta for the body in another encoding,
+// ETag differs by encoding so conditional and range requests never mix them.
+func (m *CacheMeta) derive(ce string, value []byte) *CacheMeta {
+	meta := *m
+	meta.contentEncoding = ce
+	meta.source = m
+	meta.Header = make([][]string, 0, len(m.Header))
+	for _, kv := range m.Header {
+		if len(kv) < 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Content-Length":
+			continue
+		case "Etag":
+			kv = []string{"Etag", contentETag(value, ce)}
+		}
+		meta.Header = append(meta.Header, kv)
+	}
+	return &meta
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// waitFor polls until cond is true, the background workers have no completion signal
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeriveFromCompressed(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	page := []byte(strings.Repeat("compressed by encode directive ", 100))
+	body, _ := newEncoder(false).Encode("br", page)
+
+	hdr := http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}
+	d.Set("example.com", "/a/::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), body)
+
+	for _, ce := range []string{"none", "gzip", "zstd"} {
+		waitFor(t, ce, func() bool {
+			_, _, err := d.Get("example.com", "/a/::", ce)
+			return err == nil
+		})
+		value, meta, _ := d.Get("example.com", "/a/::", ce)
+		identity, err := decode(ce, value)
+		if err != nil || !bytes.Equal(identity, page) {
+			t.Errorf("%v does not decode to the page: %v", ce, err)
+		}
+		if meta.contentEncoding != ce {
+			t.Errorf("%v meta has encoding %v", ce, meta.contentEncoding)
+		}
+	}
+	if value, _, err := d.Get("example.com", "/a/::", "br"); err != nil || !bytes.Equal(value, body) {
+		t.Errorf("source br replaced: %v", err)
+	}
+}
+
+func TestDeriveOnRead(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	c := &Cache{Store: d}
+	page := []byte(strings.Repeat("identity page ", 100))
+
+	hdr := http.Header{"Content-Type": {"text/html"}}
+	d.Set("example.com", "/a/::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), page)
+	waitFor(t, "first derive", func() bool {
+		return d.hasVariant("example.com", "/a/::", "gzip") && d.hasVariant("example.com", "/a/::", "br") && d.hasVariant("example.com", "/a/::", "zstd")
+	})
+	// lost as by a full queue or eviction
+	for _, ce := range []string{"gzip", "br", "zstd"} {
+		d.remove("example.com", "/a/::", ce)
+	}
+
+	r, _ := http.NewRequest("GET", "http://example.com/a/", nil)
+	value, _, ce, err := c.lookup(r, "example.com", "/a/::", []string{"gzip", "none"})
+	if err != nil || ce != "none" || !bytes.Equal(value, page) {
+		t.Fatalf("lookup = %v %v", ce, err)
+	}
+	waitFor(t, "derive on read", func() bool {
+		_, _, err := d.Get("example.com", "/a/::", "gzip")
+		return err == nil
+	})
+	if _, _, ce, err = c.lookup(r, "example.com", "/a/::", []string{"gzip", "none"}); err != nil || ce != "gzip" {
+		t.Errorf("lookup after derive = %v %v", ce, err)
+	}
+}
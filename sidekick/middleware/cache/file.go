@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"os"
+	"path"
+)
+
+// prefix of temp files, never matched as body or meta of an entry
+const TEMP_PREFIX = ".tmp-"
+
+// writeFileAtomic writes data to a temp file in the same directory then renames it,
+// readers see the old or the new file, never a partial one.
+// With fsync, data and the rename are flushed to disk before return, survive power loss.
+func writeFileAtomic(fp string, data []byte, fsync bool) error {
+	dir := path.Dir(fp)
+	fd, err := os.CreateTemp(dir, TEMP_PREFIX+"*")
+	if err != nil {
+		return err
+	}
+	tmp := fd.Name()
+
+	_, err = fd.Write(data)
+	if err == nil && fsync {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0o644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, fp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if fsync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entries, so a rename is durable
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
@@ -0,0 +1,61 @@
+package cache
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	fp := path.Join(dir, ".none")
+	for _, data := range []string{"first", "second, longer than first"} {
+		for _, fsync := range []bool{false, true} {
+			if err := writeFileAtomic(fp, []byte(data), fsync); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(fp)
+			if err != nil || string(got) != data {
+				t.Errorf("read %q %v, want %q", got, err, data)
+			}
+		}
+	}
+	if info, err := os.Stat(fp); err != nil || info.Mode().Perm() != 0o644 {
+		t.Errorf("mode = %v %v", info.Mode(), err)
+	}
+
+	// rename fails on a non empty directory, nothing partial left
+	blocked := path.Join(dir, ".gzip")
+	os.MkdirAll(path.Join(blocked, "x"), 0o755)
+	if err := writeFileAtomic(blocked, []byte("data"), false); err == nil {
+		t.Error("no error replacing a directory")
+	}
+	// directory gone, create fails
+	if err := writeFileAtomic(path.Join(dir, "missing", ".br"), []byte("data"), false); err == nil {
+		t.Error("no error without directory")
+	}
+	files, _ := os.ReadDir(dir)
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), TEMP_PREFIX) {
+			t.Errorf("temp file %v left", f.Name())
+		}
+	}
+}
+
+func TestSealVerify(t *testing.T) {
+	m := &CacheMeta{}
+	m.seal([]byte("body"))
+	if !m.verify([]byte("body")) {
+		t.Error("sealed body not verified")
+	}
+	for _, other := range []string{"", "bod", "body!", "Body"} {
+		if m.verify([]byte(other)) {
+			t.Errorf("%q verified", other)
+		}
+	}
+	// meta of old version has no size and checksum
+	if (&CacheMeta{}).verify([]byte("body")) {
+		t.Error("unsealed meta verified")
+	}
+}
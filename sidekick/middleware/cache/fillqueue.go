@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/puzpuzpuz/xsync"
+	"go.uber.org/zap"
+)
+
+// seconds a background fill may run, hung backend requests never hold a worker forever
+const FILL_TIMEOUT = 60
+
+// fillJob runs backend in background to fill the cache of a key
+type fillJob struct {
+	id        string
+	r         *http.Request
+	next      caddyhttp.Handler
+	cacheHost string
+	cacheKey  string
+}
+
+// fillQueue runs background fills with limited workers,
+// jobs of the key already queued or running are skipped,
+// new jobs are dropped when the queue is full.
+// Every job runs with FILL_TIMEOUT, and is cancelled by Close.
+type fillQueue struct {
+	logger  *zap.Logger
+	run     func(ctx context.Context, job *fillJob)
+	timeout time.Duration
+
+	jobs    chan *fillJob
+	pending *xsync.MapOf[string, struct{}]
+	done    chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	dropped atomic.Int64
+	running atomic.Int64
+}
+
+func newFillQueue(workers int, size int, logger *zap.Logger, run func(ctx context.Context, job *fillJob)) *fillQueue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &fillQueue{
+		logger:  logger,
+		run:     run,
+		timeout: FILL_TIMEOUT * time.Second,
+		jobs:    make(chan *fillJob, size),
+		pending: xsync.NewMapOf[struct{}](),
+		done:    make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Push adds the job, reports whether it is queued
+func (q *fillQueue) Push(job *fillJob) bool {
+	if _, loaded := q.pending.LoadOrStore(job.id, struct{}{}); loaded {
+		return false
+	}
+	select {
+	case q.jobs <- job:
+		return true
+	default:
+	}
+
+	q.pending.Delete(job.id)
+	// log some of them, traffic spike may drop a lot
+	if n := q.dropped.Add(1); n == 1 || n%100 == 0 {
+		q.logger.Warn("wp cache - fill queue full, job dropped", zap.String("id", job.id), zap.Int("queue", len(q.jobs)), zap.Int64("dropped", n))
+	}
+	return false
+}
+
+func (q *fillQueue) worker() {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		case job := <-q.jobs:
+			// select picks randomly when both ready, do not start new job after Close
+			select {
+			case <-q.done:
+				q.pending.Delete(job.id)
+				return
+			default:
+			}
+			q.running.Add(1)
+			q.runJob(job)
+			q.running.Add(-1)
+			q.pending.Delete(job.id)
+		}
+	}
+}
+
+func (q *fillQueue) runJob(job *fillJob) {
+	ctx, cancel := context.WithTimeout(q.ctx, q.timeout)
+	defer cancel()
+	q.run(ctx, job)
+}
+
+// Close stops workers, cancels the running jobs and returns after they done,
+// queued jobs are dropped
+func (q *fillQueue) Close() {
+	close(q.done)
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Stats returns the queue status for debug
+func (q *fillQueue) Stats() []string {
+	return []string{
+		fmt.Sprintf("fill_queue=%v/%v", len(q.jobs), cap(q.jobs)),
+		fmt.Sprintf("fill_running=%v", q.running.Load()),
+		fmt.Sprintf("fill_dropped=%v", q.dropped.Load()),
+	}
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestFillQueueDedupe(t *testing.T) {
+	release := make(chan struct{})
+	var runs atomic.Int32
+	q := newFillQueue(1, 4, zap.NewNop(), func(ctx context.Context, job *fillJob) {
+		runs.Add(1)
+		<-release
+	})
+	defer q.Close()
+
+	if !q.Push(&fillJob{id: "a"}) {
+		t.Fatal("first push not queued")
+	}
+	waitFor(t, "a running", func() bool { return q.running.Load() == 1 })
+	// running or queued, skipped either way
+	if q.Push(&fillJob{id: "a"}) {
+		t.Error("running job queued again")
+	}
+	if !q.Push(&fillJob{id: "b"}) || q.Push(&fillJob{id: "b"}) {
+		t.Error("queued job not deduped")
+	}
+	close(release)
+	waitFor(t, "jobs done", func() bool { return runs.Load() == 2 && q.running.Load() == 0 })
+
+	// done, can be queued again
+	waitFor(t, "pending cleared", func() bool { return q.pending.Size() == 0 })
+	if !q.Push(&fillJob{id: "a"}) {
+		t.Error("done job not queued again")
+	}
+	if q.dropped.Load() != 0 {
+		t.Errorf("dropped = %v, dedupe is not a drop", q.dropped.Load())
+	}
+}
+
+func TestFillQueueDrop(t *testing.T) {
+	release := make(chan struct{})
+	q := newFillQueue(1, 1, zap.NewNop(), func(ctx context.Context, job *fillJob) {
+		<-release
+	})
+	defer q.Close()
+	defer close(release)
+
+	q.Push(&fillJob{id: "running"})
+	waitFor(t, "running", func() bool { return q.running.Load() == 1 })
+	if !q.Push(&fillJob{id: "queued"}) {
+		t.Fatal("not queued with a free slot")
+	}
+	for _, id := range []string{"c", "d"} {
+		if q.Push(&fillJob{id: id}) {
+			t.Errorf("%v queued when full", id)
+		}
+	}
+	if n := q.dropped.Load(); n != 2 {
+		t.Errorf("dropped = %v, want 2", n)
+	}
+	// dropped ones are not pending, queued again later
+	if _, ok := q.pending.Load("c"); ok {
+		t.Error("dropped job still pending")
+	}
+}
+
+func TestFillQueueClose(t *testing.T) {
+	var canceled, queuedRun atomic.Bool
+	q := newFillQueue(1, 4, zap.NewNop(), func(ctx context.Context, job *fillJob) {
+		if job.id == "queued" {
+			queuedRun.Store(true)
+			return
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("job without deadline")
+		}
+		// hung backend, only ends by the context
+		<-ctx.Done()
+		canceled.Store(true)
+	})
+	q.Push(&fillJob{id: "hung"})
+	waitFor(t, "running", func() bool { return q.running.Load() == 1 })
+	q.Push(&fillJob{id: "queued"})
+
+	closed := make(chan struct{})
+	go func() {
+		q.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked by running job")
+	}
+	if !canceled.Load() {
+		t.Error("Close returned before the running job done")
+	}
+	if queuedRun.Load() {
+		t.Error("queued job run after Close")
+	}
+}
+
+func TestFillQueueTimeout(t *testing.T) {
+	done := make(chan error, 1)
+	q := newFillQueue(1, 1, zap.NewNop(), func(ctx context.Context, job *fillJob) {
+		<-ctx.Done()
+		done <- ctx.Err()
+	})
+	defer q.Close()
+	q.timeout = 10 * time.Millisecond
+
+	q.Push(&fillJob{id: "hung"})
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Errorf("err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("job never timed out")
+	}
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/puzpuzpuz/xsync"
+)
+
+// diskIndex records the original keys of one host on disk,
+// purge by prefix finds the hashed directories from it instead of reading every meta.
+// Built by one walk of the host directory, Set adds keys after.
+type diskIndex struct {
+	once sync.Once
+	keys *xsync.MapOf[string, struct{}]
+}
+
+// hostIndex returns the index of the host directory, keys may not be loaded yet
+func (d *Store) hostIndex(hostPath string) *diskIndex {
+	if idx, ok := d.index.Load(hostPath); ok {
+		return idx
+	}
+	// not LoadOrCompute, it may store another value than the returned one
+	idx, _ := d.index.LoadOrStore(hostPath, &diskIndex{keys: xsync.NewMapOf[struct{}]()})
+	return idx
+}
+
+// loadIndex returns the index of the host directory with keys on disk loaded,
+// waits if another one is loading.
+func (d *Store) loadIndex(hostPath string) *diskIndex {
+	idx := d.hostIndex(hostPath)
+	idx.once.Do(func() {
+		d.walkHostDir(hostPath, func(hostPath string, fp string, meta *CacheMeta) {
+			idx.keys.Store(meta.Key, struct{}{})
+		})
+	})
+	return idx
+}
+
+// warmIndex loads the index of all hosts, so the first purge does not walk the disk
+func (d *Store) warmIndex() {
+	for _, hostPath := range d.listHostDirs("") {
+		d.loadIndex(hostPath)
+	}
+}
+
+// dropIndex forgets the keys of the host, empty host means all hosts
+func (d *Store) dropIndex(host string) {
+	if host != "" {
+		d.index.Delete(hostDir(host))
+		return
+	}
+	d.index.Range(func(hostPath string, _ *diskIndex) bool {
+		d.index.Delete(hostPath)
+		return true
+	})
+}
+
+// match returns the keys with the prefix
+func (idx *diskIndex) match(prefix string) []string {
+	keys := make([]string, 0, 4)
+	idx.keys.Range(func(key string, _ struct{}) bool {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+const (
+	QueryIgnore = "ignore" // query not part of the key
+	QueryAll    = "all"    // all query params are part of the key
+	QueryAllow  = "allow"  // only listed query params are part of the key
+	QueryDeny   = "deny"   // all query params except listed are part of the key
+)
+
+// marketing params, which never change the page content
+var defaultQueryStrip = []string{
+	"utm_*",
+	"fbclid",
+	"gclid",
+}
+
+// buildRequestKey returns the key for both lookup and fill of the request.
+// The path and normalized query are always the prefix of the key,
+// so purge by path prefix still works, the rest comes from the `cache_key` template
+// and the `vary_cookies` values, eg:
+//
+//	cache_key {http.request.host}|{header.Accept-Language}|{cookie.pll_language}
+func (c *Cache) buildRequestKey(r *http.Request) string {
+	cacheKey := ""
+	if c.CacheKey != "" {
+		repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+		if !ok {
+			repl = caddy.NewReplacer()
+		}
+		cacheKey = repl.ReplaceAll(c.CacheKey, "")
+	}
+	if vary := c.varyCookies.varyCookies(r.Cookies()); len(vary) > 0 {
+		cacheKey += "|" + strings.Join(vary, "&")
+	}
+
+	reqPath := r.URL.Path
+	if query := c.normalizeQuery(r.URL.RawQuery); query != "" {
+		reqPath += "?" + query
+	}
+	return c.Store.buildCacheKey(reqPath, cacheKey)
+}
+
+// expandShorthands replaces Caddyfile placeholder shorthands like `{path}` or `{header.*}`
+// with the full names, the Caddyfile adapter does it for directives,
+// but not for the value from env or JSON config, the replacer leaves them empty.
+func expandShorthands(template string) string {
+	if template == "" {
+		return ""
+	}
+	segment := caddyfile.Segment{caddyfile.Token{Text: template}}
+	httpcaddyfile.NewShorthandReplacer().ApplyToSegment(&segment)
+	return segment[0].Text
+}
+
+// placeholders of the whole path or query, the key already starts with them normalized
+var uriPlaceholderRx = regexp.MustCompile(`\{http\.request\.(orig_)?uri(\.path|\.query)?\}`)
+
+// stripURIPlaceholders removes `{path}`, `{query}` and `{uri}` in full names from the template,
+// the raw query with tracking params in the key would defeat `cache_query` and `cache_query_strip`.
+// Reports whether any removed.
+func stripURIPlaceholders(template string) (string, bool) {
+	stripped := uriPlaceholderRx.ReplaceAllString(template, "")
+	return stripped, stripped != template
+}
+
+// requestHost returns the host namespace of the request,
+// empty if all hosts share one cache (`ignore_host`)
+func (c *Cache) requestHost(r *http.Request) string {
+	if c.IgnoreHost {
+		return ""
+	}
+	return normalizeHost(r.Host)
+}
+
+// normalizeHost lowercases host and strips the port
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// normalizeQuery filters query params by the `cache_query` policy and `cache_query_strip`,
+// the result is sorted by param name so `?b=2&a=1` and `?a=1&b=2` share the same key.
+func (c *Cache) normalizeQuery(rawQuery string) string {
+	if rawQuery == "" || c.CacheQuery == QueryIgnore {
+		return ""
+	}
+
+	// keep what can be parsed even with error
+	query, _ := url.ParseQuery(rawQuery)
+	for name := range query {
+		if matchQueryParam(c.CacheQueryStrip, name) {
+			delete(query, name)
+			continue
+		}
+		switch c.CacheQuery {
+		case QueryAllow:
+			if !matchQueryParam(c.CacheQueryParams, name) {
+				delete(query, name)
+			}
+		case QueryDeny:
+			if matchQueryParam(c.CacheQueryParams, name) {
+				delete(query, name)
+			}
+		}
+	}
+	return query.Encode()
+}
+
+// matchQueryParam reports whether name in list, item with suffix `*` match by prefix
+func matchQueryParam(list []string, name string) bool {
+	for _, param := range list {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits comma separated args, empty items are skipped
+func splitList(args []string) []string {
+	list := make([]string, 0, len(args))
+	for _, arg := range args {
+		for _, item := range strings.Split(arg, ",") {
+			item = strings.TrimSpace(item)
+			if item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,26 @@
+package cache
+
+import "testing"
+
+func TestCacheKeyTemplate(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{"", ""},
+		{"{http.request.host}|{header.Accept-Language}", "{http.request.host}|{http.request.header.Accept-Language}"},
+		{"{cookie.pll_language}", "{http.request.cookie.pll_language}"},
+		// path and query are the normalized prefix of the key already
+		{"{http.request.host}{path}?{query}", "{http.request.host}?"},
+		{"{uri}|{host}", "|{http.request.host}"},
+		{"{http.request.orig_uri.query}{http.request.uri.path}", ""},
+		// one param is kept on purpose
+		{"{query.lang}", "{http.request.uri.query.lang}"},
+	}
+	for _, tt := range tests {
+		got, _ := stripURIPlaceholders(expandShorthands(tt.template))
+		if got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
@@ -2,188 +2,260 @@ package cache
 
 import (
 	"container/list"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
 
-	"github.com/puzpuzpuz/xsync"
+const (
+	// upper bound of shards, more shards only waste memory
+	LRU_MAX_SHARDS = 64
+	// keep enough items in every shard, or eviction is far from LRU
+	LRU_MIN_SHARD_COUNT = 32
 )
 
-type LRUCache[K comparable, V any] struct {
-	capacityCount int
+// LRUCache is an approximate LRU split into shards by key hash.
+// Every shard has its own lock, and recency is tracked by CLOCK bits,
+// so Get only takes the read lock and never moves list elements.
+// Limits of count and cost are global, a shard evicts its own entries first, then others.
+type LRUCache[K comparable, V comparable] struct {
+	capacityCount int64
 	capacityCost  int64
 
-	mu          xsync.RBMutex
-	ll          *list.List
-	cache       map[K]*list.Element
-	currentCost int64
+	seed   maphash.Seed
+	shards []*lruShard[K, V]
+	mask   uint64
+
+	currentCount atomic.Int64
+	currentCost  atomic.Int64
+}
 
-	// TODO: use concurrent map?
-	// cache *xsync.MapOf[K, *list.Element]
+// lruShard uses sync.RWMutex, readers are spread over shards already,
+// xsync.RBMutex costs 16 KB per shard for reader slots
+type lruShard[K comparable, V comparable] struct {
+	mu    sync.RWMutex
+	ll    *list.List // front is the newest, eviction scans from back
+	cache map[K]*list.Element
 }
 
-type entry[K comparable, V any] struct {
+type entry[K comparable, V comparable] struct {
 	key   K
 	value *V
 	cost  int
+	// set on read, cleared by eviction as second chance
+	visited atomic.Bool
 	// value weak.Pointer[V] // Store weak pointer to the actual value
 }
 
-func NewLRUCache[K comparable, V any](capacityCount int, capacityCost int) *LRUCache[K, V] {
-	return &LRUCache[K, V]{
-		capacityCount: capacityCount,
+func NewLRUCache[K comparable, V comparable](capacityCount int, capacityCost int) *LRUCache[K, V] {
+	n := lruShardCount(capacityCount)
+	c := &LRUCache[K, V]{
+		capacityCount: int64(capacityCount),
 		capacityCost:  int64(capacityCost),
-		cache:         make(map[K]*list.Element),
-		ll:            list.New(),
+		seed:          maphash.MakeSeed(),
+		shards:        make([]*lruShard[K, V], n),
+		mask:          uint64(n - 1),
 	}
+	for i := range c.shards {
+		c.shards[i] = &lruShard[K, V]{
+			cache: make(map[K]*list.Element),
+			ll:    list.New(),
+		}
+	}
+	return c
+}
+
+// lruShardCount returns a power of 2 scaled by CPUs, less for a small capacity
+func lruShardCount(capacityCount int) int {
+	n := 1
+	for n < runtime.GOMAXPROCS(0)*4 && n < LRU_MAX_SHARDS {
+		n <<= 1
+	}
+	for capacityCount > 0 && n > 1 && capacityCount/n < LRU_MIN_SHARD_COUNT {
+		n >>= 1
+	}
+	return n
+}
+
+func (c *LRUCache[K, V]) shard(key K) (int, *lruShard[K, V]) {
+	i := int(maphash.Comparable(c.seed, key) & c.mask)
+	return i, c.shards[i]
 }
 
 func (c *LRUCache[K, V]) Size() int {
-	tk := c.mu.RLock()
-	defer c.mu.RUnlock(tk)
-	return len(c.cache)
+	return int(c.currentCount.Load())
 }
 
 func (c *LRUCache[K, V]) Cost() int {
-	tk := c.mu.RLock()
-	defer c.mu.RUnlock(tk)
-	return int(c.currentCost)
+	return int(c.currentCost.Load())
 }
 
 func (c *LRUCache[K, V]) Get(key K) (*V, bool) {
-	tk := c.mu.RLock()
-	defer c.mu.RUnlock(tk)
-	return c.get(key, true)
+	_, s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(key, true)
 }
 
 func (c *LRUCache[K, V]) Peek(key K) (*V, bool) {
-	tk := c.mu.RLock()
-	defer c.mu.RUnlock(tk)
-	return c.get(key, false)
+	_, s := c.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.get(key, false)
 }
 
-func (c *LRUCache[K, V]) get(key K, touch bool) (*V, bool) {
-	if elem, ok := c.cache[key]; ok {
-		if touch {
-			c.ll.MoveToFront(elem)
-		}
+// get is safe under the read lock, touch only sets the CLOCK bit
+func (s *lruShard[K, V]) get(key K, touch bool) (*V, bool) {
+	if elem, ok := s.cache[key]; ok {
 		valEntry := elem.Value.(*entry[K, V])
+		// skip the store if already set, keep the cache line shared between readers
+		if touch && !valEntry.visited.Load() {
+			valEntry.visited.Store(true)
+		}
 		return valEntry.value, true
-
-		// Attempt to get the strong pointer from the weak pointer
-		// if strongVal := valEntry.value.Value(); strongVal != nil {
-		// 	return strongVal, true
-		// } else {
-		// 	// Object has been garbage collected, remove from cache
-		// 	c.removeElement(elem)
-		// 	return nil, false
-		// }
 	}
 	return nil, false
 }
 
 func (c *LRUCache[K, V]) Put(key K, value V, cost int) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	return c.put(key, value, cost)
+	i, s := c.shard(key)
+	s.mu.Lock()
+	existed := c.put(s, key, value, cost)
+	s.mu.Unlock()
+
+	c.evict(i)
+	return existed
 }
 
-func (c *LRUCache[K, V]) put(key K, value V, cost int) bool {
-	if elem, ok := c.cache[key]; ok {
-		c.ll.MoveToFront(elem)
+// put should hold the write lock of s, call evict after unlock
+func (c *LRUCache[K, V]) put(s *lruShard[K, V], key K, value V, cost int) bool {
+	if elem, ok := s.cache[key]; ok {
 		valEntry := elem.Value.(*entry[K, V])
 		valEntry.value = &value // weak.Make(&value) // Update weak pointer
+		valEntry.visited.Store(true)
 
 		// update cost
-		c.currentCost = c.currentCost - int64(valEntry.cost) + int64(cost)
+		c.currentCost.Add(int64(cost) - int64(valEntry.cost))
 		valEntry.cost = cost
-
-		c.evictByCost()
 		return true
 	}
 
-	c.checkAndEvict()
-
 	newEntry := &entry[K, V]{
 		key:   key,
 		value: &value, // weak.Make(&value),
 		cost:  cost,
 	}
-	elem := c.ll.PushFront(newEntry)
-	c.cache[key] = elem
-	c.currentCost += int64(cost)
+	elem := s.ll.PushFront(newEntry)
+	s.cache[key] = elem
+	c.currentCount.Add(1)
+	c.currentCost.Add(int64(cost))
 	return false
 }
 
 func (c *LRUCache[K, V]) Delete(key K) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	_, s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	if elem, ok := c.cache[key]; ok {
-		c.removeElement(elem)
+	if elem, ok := s.cache[key]; ok {
+		c.removeElement(s, elem)
 	}
 }
 
-func (c *LRUCache[K, V]) removeElement(e *list.Element) {
-	c.ll.Remove(e)
+// CompareAndDelete deletes the entry of key only if its value is same as old,
+// reports whether deleted.
+func (c *LRUCache[K, V]) CompareAndDelete(key K, old V) bool {
+	_, s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.cache[key]; ok {
+		valEntry := elem.Value.(*entry[K, V])
+		if *valEntry.value == old {
+			c.removeElement(s, elem)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *LRUCache[K, V]) removeElement(s *lruShard[K, V], e *list.Element) {
+	s.ll.Remove(e)
 	ent := e.Value.(*entry[K, V])
-	delete(c.cache, ent.key)
-	c.currentCost -= int64(ent.cost)
+	delete(s.cache, ent.key)
+	c.currentCount.Add(-1)
+	c.currentCost.Add(-int64(ent.cost))
 }
 
-func (c *LRUCache[K, V]) evictByCount() {
-	// if define limit of count
-	if c.capacityCount <= 0 {
-		return
-	}
-	for c.ll.Len() >= c.capacityCount {
-		elem := c.ll.Back()
-		c.removeElement(elem)
-	}
+func (c *LRUCache[K, V]) overLimit() bool {
+	// if define limit of count or cost
+	return (c.capacityCount > 0 && c.currentCount.Load() > c.capacityCount) ||
+		(c.capacityCost > 0 && c.currentCost.Load() > c.capacityCost)
 }
 
-func (c *LRUCache[K, V]) evictByCost() {
-	// if define limit of cost
-	if c.capacityCost <= 0 {
-		return
-	}
-	for c.currentCost > int64(c.capacityCost) {
-		elem := c.ll.Back()
-		c.removeElement(elem)
+// evict removes entries until under limits, from shard i then the next ones.
+// Only one shard is locked at a time.
+func (c *LRUCache[K, V]) evict(i int) {
+	for n := 0; n < len(c.shards) && c.overLimit(); n++ {
+		s := c.shards[(i+n)&int(c.mask)]
+		s.mu.Lock()
+		for c.overLimit() && c.evictOne(s) {
+		}
+		s.mu.Unlock()
 	}
 }
 
-func (c *LRUCache[K, V]) checkAndEvict() {
-	c.evictByCount()
-	c.evictByCost()
+// evictOne removes the oldest entry not visited since last scan,
+// visited ones get a second chance and move to front.
+// Should hold the write lock, reports false if the shard is empty.
+func (c *LRUCache[K, V]) evictOne(s *lruShard[K, V]) bool {
+	// every entry is cleared after one round, so at most 2 rounds
+	for n := 2 * s.ll.Len(); n > 0; n-- {
+		elem := s.ll.Back()
+		ent := elem.Value.(*entry[K, V])
+		if ent.visited.Swap(false) {
+			s.ll.MoveToFront(elem)
+			continue
+		}
+		c.removeElement(s, elem)
+		return true
+	}
+	return false
 }
 
 // LoadOrCompute returns the existing value for the key if present.
 // Otherwise, it computes the value using the provided function and returns the computed value.
 // The loaded result is true if the value was loaded, false if stored.
+// valueFn runs with the lock of one shard held, other shards are not blocked.
 func (c *LRUCache[K, V]) LoadOrCompute(key K, valueFn func() (V, int, bool)) (actual V, loaded bool) {
-	tk := c.mu.RLock()
-	val, ok := c.get(key, true)
+	i, s := c.shard(key)
+	s.mu.RLock()
+	val, ok := s.get(key, true)
+	s.mu.RUnlock()
 	if ok {
-		c.mu.RUnlock(tk)
 		return *val, true
 	}
-	c.mu.RUnlock(tk)
 
 	// upgrade lock
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
+	s.mu.Lock()
 	// check again if someone already set value between we release read lock and  get write lock
-	val, ok = c.get(key, true)
+	val, ok = s.get(key, true)
 	if ok {
+		s.mu.Unlock()
 		return *val, true
 	}
 
 	// still no value, call compute function
 	newVal, cost, needSet := valueFn()
-	if !needSet {
-		return newVal, false
+	if needSet {
+		c.put(s, key, newVal, cost)
 	}
+	s.mu.Unlock()
 
-	c.put(key, newVal, cost)
+	if needSet {
+		c.evict(i)
+	}
 	return newVal, false
 }
 
@@ -198,15 +270,24 @@ func (c *LRUCache[K, V]) LoadOrCompute(key K, valueFn func() (V, int, bool)) (ac
 //
 // Should NOT modify the map while iterating it.
 func (c *LRUCache[K, V]) Range(f func(key K, value V) bool) {
-	tk := c.mu.RLock()
-	defer c.mu.RUnlock(tk)
-	for k := range c.cache {
-		v, ok := c.get(k, false)
+	for _, s := range c.shards {
+		if !s.rangeShard(f) {
+			return
+		}
+	}
+}
+
+func (s *lruShard[K, V]) rangeShard(f func(key K, value V) bool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for k := range s.cache {
+		v, ok := s.get(k, false)
 		if !ok {
 			continue
 		}
 		if !f(k, *v) {
-			return
+			return false
 		}
 	}
+	return true
 }
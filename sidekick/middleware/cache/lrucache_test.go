@@ -0,0 +1,472 @@
+package cache
+
+import (
+	"container/list"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/puzpuzpuz/xsync"
+)
+
+func TestLRUCacheCount(t *testing.T) {
+	c := NewLRUCache[string, int](256, -1)
+	for i := 0; i < 1000; i++ {
+		c.Put("key"+strconv.Itoa(i), i, 3)
+	}
+	n := 0
+	c.Range(func(key string, value int) bool {
+		n++
+		return true
+	})
+	if c.Size() != 256 || n != 256 || c.Cost() != 256*3 {
+		t.Errorf("size = %v, range = %v, cost = %v, want 256 entries of cost 3", c.Size(), n, c.Cost())
+	}
+}
+
+func TestLRUCacheCost(t *testing.T) {
+	c := NewLRUCache[string, int](-1, 1000)
+	for i := 0; i < 100; i++ {
+		c.Put("key"+strconv.Itoa(i), i, 50)
+	}
+	if c.Size() != 20 || c.Cost() != 1000 {
+		t.Fatalf("size = %v, cost = %v, want 20 and 1000", c.Size(), c.Cost())
+	}
+
+	// replace updates cost, not count
+	if !c.Put("key99", 0, 10) {
+		t.Fatal("key99 should exist")
+	}
+	if c.Size() != 20 || c.Cost() != 960 {
+		t.Errorf("after replace size = %v, cost = %v", c.Size(), c.Cost())
+	}
+	c.Delete("key99")
+	c.Delete("missing")
+	if c.Size() != 19 || c.Cost() != 950 {
+		t.Errorf("after delete size = %v, cost = %v", c.Size(), c.Cost())
+	}
+
+	// larger than the whole cache, never kept
+	c.Put("big", 0, 5000)
+	if _, ok := c.Peek("big"); ok || c.Cost() > 1000 {
+		t.Errorf("big kept, cost = %v", c.Cost())
+	}
+	if c.Cost() < 0 || c.Size() < 0 {
+		t.Errorf("negative accounting: size = %v, cost = %v", c.Size(), c.Cost())
+	}
+}
+
+func TestLRUCacheSecondChance(t *testing.T) {
+	// small capacity always has one shard, eviction order is exact
+	c := NewLRUCache[string, int](32, -1)
+	if len(c.shards) != 1 {
+		t.Fatalf("shards = %v, want 1", len(c.shards))
+	}
+	for i := 0; i < 32; i++ {
+		c.Put("key"+strconv.Itoa(i), i, 1)
+	}
+
+	// visited survives, the oldest not visited is evicted
+	c.Get("key0")
+	c.Put("new1", 0, 1)
+	if _, ok := c.Peek("key0"); !ok {
+		t.Error("visited key0 evicted")
+	}
+	if _, ok := c.Peek("key1"); ok {
+		t.Error("key1 should be evicted")
+	}
+
+	// Peek does not count as visit
+	c.Peek("key2")
+	c.Put("new2", 0, 1)
+	if _, ok := c.Peek("key2"); ok {
+		t.Error("key2 should be evicted")
+	}
+
+	// key0 moved behind new1, evicted when its turn comes again without visit
+	for i := 3; i < 32; i++ {
+		c.Put("more"+strconv.Itoa(i), 0, 1)
+	}
+	if _, ok := c.Peek("key0"); !ok {
+		t.Error("key0 evicted before new1")
+	}
+	c.Put("last1", 0, 1)
+	c.Put("last2", 0, 1)
+	if _, ok := c.Peek("key0"); ok {
+		t.Error("key0 should be evicted after its second chance")
+	}
+	if c.Size() != 32 {
+		t.Errorf("size = %v", c.Size())
+	}
+}
+
+func TestLRUCacheCompareAndDelete(t *testing.T) {
+	a, b := new(int), new(int)
+	c := NewLRUCache[string, *int](10, 100)
+	c.Put("k", a, 7)
+
+	if c.CompareAndDelete("k", b) {
+		t.Error("deleted with another value")
+	}
+	if v, ok := c.Peek("k"); !ok || *v != a {
+		t.Error("k removed by mismatched CompareAndDelete")
+	}
+	if c.CompareAndDelete("missing", a) {
+		t.Error("deleted missing key")
+	}
+	if !c.CompareAndDelete("k", a) {
+		t.Error("not deleted with same value")
+	}
+	if _, ok := c.Peek("k"); ok || c.Size() != 0 || c.Cost() != 0 {
+		t.Errorf("after delete size = %v, cost = %v", c.Size(), c.Cost())
+	}
+}
+
+func TestLRUCacheLoadOrCompute(t *testing.T) {
+	c := NewLRUCache[string, int](10, -1)
+	v, loaded := c.LoadOrCompute("k", func() (int, int, bool) { return 1, 1, false })
+	if v != 1 || loaded || c.Size() != 0 {
+		t.Errorf("not stored: v = %v, loaded = %v, size = %v", v, loaded, c.Size())
+	}
+	v, loaded = c.LoadOrCompute("k", func() (int, int, bool) { return 2, 1, true })
+	if v != 2 || loaded || c.Size() != 1 {
+		t.Errorf("stored: v = %v, loaded = %v, size = %v", v, loaded, c.Size())
+	}
+	v, loaded = c.LoadOrCompute("k", func() (int, int, bool) {
+		t.Error("computed with existing value")
+		return 3, 1, true
+	})
+	if v != 2 || !loaded {
+		t.Errorf("loaded: v = %v, loaded = %v", v, loaded)
+	}
+}
+
+// run with -race, the read path was a data race before sharding
+func TestLRUCacheConcurrent(t *testing.T) {
+	c := NewLRUCache[string, int](512, -1)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			r := rand.New(rand.NewPCG(uint64(g), 0))
+			for i := 0; i < 20000; i++ {
+				key := "key" + strconv.Itoa(r.IntN(2048))
+				switch r.IntN(10) {
+				case 0:
+					c.Put(key, i, 1)
+				case 1:
+					c.Delete(key)
+				case 2:
+					c.CompareAndDelete(key, i)
+				case 3:
+					c.LoadOrCompute(key, func() (int, int, bool) { return i, 1, true })
+				default:
+					c.Get(key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	n := 0
+	c.Range(func(key string, value int) bool {
+		n++
+		return true
+	})
+	if c.Size() != n || c.Cost() != n || n > 512 {
+		t.Errorf("size = %v, cost = %v, range = %v", c.Size(), c.Cost(), n)
+	}
+}
+
+// legacyLRUCache is LRUCache before sharding, copied as is for BenchmarkLRUCacheParallel.
+// Get and LoadOrCompute move list elements under the read lock, which is the data race
+// the redesign fixes, so the benchmark should not run with -race.
+type legacyLRUCache[K comparable, V any] struct {
+	capacityCount int
+	capacityCost  int64
+
+	mu          xsync.RBMutex
+	ll          *list.List
+	cache       map[K]*list.Element
+	currentCost int64
+
+	// TODO: use concurrent map?
+	// cache *xsync.MapOf[K, *list.Element]
+}
+
+type legacyEntry[K comparable, V any] struct {
+	key   K
+	value *V
+	cost  int
+	// value weak.Pointer[V] // Store weak pointer to the actual value
+}
+
+func newLegacyLRUCache[K comparable, V any](capacityCount int, capacityCost int) *legacyLRUCache[K, V] {
+	return &legacyLRUCache[K, V]{
+		capacityCount: capacityCount,
+		capacityCost:  int64(capacityCost),
+		cache:         make(map[K]*list.Element),
+		ll:            list.New(),
+	}
+}
+
+func (c *legacyLRUCache[K, V]) Size() int {
+	tk := c.mu.RLock()
+	defer c.mu.RUnlock(tk)
+	return len(c.cache)
+}
+
+func (c *legacyLRUCache[K, V]) Cost() int {
+	tk := c.mu.RLock()
+	defer c.mu.RUnlock(tk)
+	return int(c.currentCost)
+}
+
+func (c *legacyLRUCache[K, V]) Get(key K) (*V, bool) {
+	tk := c.mu.RLock()
+	defer c.mu.RUnlock(tk)
+	return c.get(key, true)
+}
+
+func (c *legacyLRUCache[K, V]) Peek(key K) (*V, bool) {
+	tk := c.mu.RLock()
+	defer c.mu.RUnlock(tk)
+	return c.get(key, false)
+}
+
+func (c *legacyLRUCache[K, V]) get(key K, touch bool) (*V, bool) {
+	if elem, ok := c.cache[key]; ok {
+		if touch {
+			c.ll.MoveToFront(elem)
+		}
+		valEntry := elem.Value.(*legacyEntry[K, V])
+		return valEntry.value, true
+
+		// Attempt to get the strong pointer from the weak pointer
+		// if strongVal := valEntry.value.Value(); strongVal != nil {
+		// 	return strongVal, true
+		// } else {
+		// 	// Object has been garbage collected, remove from cache
+		// 	c.removeElement(elem)
+		// 	return nil, false
+		// }
+	}
+	return nil, false
+}
+
+func (c *legacyLRUCache[K, V]) Put(key K, value V, cost int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.put(key, value, cost)
+}
+
+func (c *legacyLRUCache[K, V]) put(key K, value V, cost int) bool {
+	if elem, ok := c.cache[key]; ok {
+		c.ll.MoveToFront(elem)
+		valEntry := elem.Value.(*legacyEntry[K, V])
+		valEntry.value = &value // weak.Make(&value) // Update weak pointer
+
+		// update cost
+		c.currentCost = c.currentCost - int64(valEntry.cost) + int64(cost)
+		valEntry.cost = cost
+
+		c.evictByCost()
+		return true
+	}
+
+	c.checkAndEvict()
+
+	newEntry := &legacyEntry[K, V]{
+		key:   key,
+		value: &value, // weak.Make(&value),
+		cost:  cost,
+	}
+	elem := c.ll.PushFront(newEntry)
+	c.cache[key] = elem
+	c.currentCost += int64(cost)
+	return false
+}
+
+func (c *legacyLRUCache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.cache[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// CompareAndDelete deletes the entry of key only if its value is same as old,
+// reports whether deleted.
+func (c *legacyLRUCache[K, V]) CompareAndDelete(key K, old V) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.cache[key]; ok {
+		valEntry := elem.Value.(*legacyEntry[K, V])
+		if any(*valEntry.value) == any(old) {
+			c.removeElement(elem)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *legacyLRUCache[K, V]) removeElement(e *list.Element) {
+	c.ll.Remove(e)
+	ent := e.Value.(*legacyEntry[K, V])
+	delete(c.cache, ent.key)
+	c.currentCost -= int64(ent.cost)
+}
+
+func (c *legacyLRUCache[K, V]) evictByCount() {
+	// if define limit of count
+	if c.capacityCount <= 0 {
+		return
+	}
+	for c.ll.Len() >= c.capacityCount {
+		elem := c.ll.Back()
+		c.removeElement(elem)
+	}
+}
+
+func (c *legacyLRUCache[K, V]) evictByCost() {
+	// if define limit of cost
+	if c.capacityCost <= 0 {
+		return
+	}
+	for c.currentCost > int64(c.capacityCost) {
+		elem := c.ll.Back()
+		c.removeElement(elem)
+	}
+}
+
+func (c *legacyLRUCache[K, V]) checkAndEvict() {
+	c.evictByCount()
+	c.evictByCost()
+}
+
+// LoadOrCompute returns the existing value for the key if present.
+// Otherwise, it computes the value using the provided function and returns the computed value.
+// The loaded result is true if the value was loaded, false if stored.
+func (c *legacyLRUCache[K, V]) LoadOrCompute(key K, valueFn func() (V, int, bool)) (actual V, loaded bool) {
+	tk := c.mu.RLock()
+	val, ok := c.get(key, true)
+	if ok {
+		c.mu.RUnlock(tk)
+		return *val, true
+	}
+	c.mu.RUnlock(tk)
+
+	// upgrade lock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// check again if someone already set value between we release read lock and  get write lock
+	val, ok = c.get(key, true)
+	if ok {
+		return *val, true
+	}
+
+	// still no value, call compute function
+	newVal, cost, needSet := valueFn()
+	if !needSet {
+		return newVal, false
+	}
+
+	c.put(key, newVal, cost)
+	return newVal, false
+}
+
+// Range calls f sequentially for each key and value present in the
+// map. If f returns false, range stops the iteration.
+//
+// Range does not necessarily correspond to any consistent snapshot
+// of the Map's contents: no key will be visited more than once, but
+// if the value for any key is stored or deleted concurrently, Range
+// may reflect any mapping for that key from any point during the
+// Range call.
+//
+// Should NOT modify the map while iterating it.
+func (c *legacyLRUCache[K, V]) Range(f func(key K, value V) bool) {
+	tk := c.mu.RLock()
+	defer c.mu.RUnlock(tk)
+	for k := range c.cache {
+		v, ok := c.get(k, false)
+		if !ok {
+			continue
+		}
+		if !f(k, *v) {
+			return
+		}
+	}
+}
+
+type benchLRU interface {
+	Get(key string) (*int, bool)
+	Put(key string, value int, cost int) bool
+}
+
+const (
+	benchLRUKeys     = 1 << 14
+	benchLRUCapacity = 1 << 13
+)
+
+// BenchmarkLRUCacheParallel compares both under parallel load,
+// half of the keys fit, so misses put and evict as a page cache does.
+// Run with: go test -run ^$ -bench LRUCacheParallel -cpu 1,4,16
+func BenchmarkLRUCacheParallel(b *testing.B) {
+	keys := make([]string, benchLRUKeys)
+	for i := range keys {
+		keys[i] = "example.com/page/" + strconv.Itoa(i) + "::none"
+	}
+
+	impls := []struct {
+		name string
+		new  func() benchLRU
+	}{
+		{"legacy", func() benchLRU { return newLegacyLRUCache[string, int](benchLRUCapacity, -1) }},
+		{"sharded", func() benchLRU { return NewLRUCache[string, int](benchLRUCapacity, -1) }},
+	}
+	loads := []struct {
+		name     string
+		putEvery int // one put in every n operations, 0 only puts on miss
+	}{
+		{"read", 0},
+		{"mixed", 10},
+	}
+
+	for _, load := range loads {
+		for _, impl := range impls {
+			b.Run(load.name+"/"+impl.name, func(b *testing.B) {
+				c := impl.new()
+				for i := 0; i < benchLRUCapacity; i++ {
+					c.Put(keys[i], i, 1)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					// mostly the first half, like hot pages
+					r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+					n := 0
+					for pb.Next() {
+						i := r.IntN(benchLRUCapacity)
+						if r.IntN(8) == 0 {
+							i = r.IntN(benchLRUKeys)
+						}
+						n++
+						if load.putEvery > 0 && n%load.putEvery == 0 {
+							c.Put(keys[i], i, 1)
+							continue
+						}
+						if _, ok := c.Get(keys[i]); !ok {
+							c.Put(keys[i], i, 1)
+						}
+					}
+				})
+			})
+		}
+	}
+}
@@ -2,10 +2,11 @@ package cache
 
 import (
 	"encoding/json"
+	"hash/crc32"
 	"net/http"
+	"net/textproto"
 	"os"
 	"slices"
-	"strings"
 	"time"
 )
 
@@ -43,7 +44,7 @@ var (
 		"X-Powered-By",
 
 		// TODO:
-		"Vary",
+		// "Vary", // recorded in CacheMeta.Vary, merged on output
 		"Link",
 		"Expires",
 		"Age",
@@ -60,6 +61,13 @@ var (
 		"X-UA-Compatible",
 	}
 
+	// never stored even if configured, handled by cache itself or belong to one visitor
+	hdrResNeverCacheList = []string{
+		"Content-Encoding",
+		"Vary",
+		"Set-Cookie",
+	}
+
 	// bypass if response has any of these header
 	hdrResNotCacheList = []string{
 		"Content-Range",
@@ -82,14 +90,23 @@ var (
 )
 
 type CacheMeta struct {
-	StateCode int        `json:"c,omitempty"`
-	Header    [][]string `json:"h,omitempty"`
-	Timestamp int64      `json:"t,omitempty"`
+	Key           string     `json:"k,omitempty"` // original key, on disk the key is hashed
+	StateCode     int        `json:"c,omitempty"`
+	Header        [][]string `json:"h,omitempty"` // [name, value1, value2, ...]
+	Timestamp     int64      `json:"t,omitempty"`
+	TTL           int        `json:"l,omitempty"` // seconds, 0 means global ttl, < 0 means never expire
+	StaleTTL      int        `json:"s,omitempty"` // seconds can be served after expired while refreshing
+	StaleErrorTTL int        `json:"e,omitempty"` // seconds can be served after expired when upstream failed
+	Vary          []string   `json:"v,omitempty"` // response Vary header names, except Accept-Encoding
+	Size          int        `json:"n"`           // body length on disk
+	Checksum      uint32     `json:"x"`           // CRC-32C of body on disk
 
 	contentEncoding string
+	// the body from backend this one derived from, nil if from backend
+	source *CacheMeta
 }
 
-func NewCacheMeta(stateCode int, hdr http.Header) *CacheMeta {
+func NewCacheMeta(stateCode int, hdr http.Header, allowList []string) *CacheMeta {
 	// content encoding
 	ce := hdr.Get("Content-Encoding")
 	if ce == "" {
@@ -105,30 +122,106 @@ func NewCacheMeta(stateCode int, hdr http.Header) *CacheMeta {
 		StateCode: stateCode,
 		Header:    make([][]string, 0, 8),
 		Timestamp: time.Now().Unix(),
+		Vary:      parseVary(hdr),
 
 		contentEncoding: ce,
 	}
-	meta.SetHeader(hdr)
+	meta.SetHeader(hdr, allowList)
 	return meta
 }
 
-func (m *CacheMeta) SetHeader(hdr http.Header) {
+// SetHeader records headers in allowList, every value kept as is
+func (m *CacheMeta) SetHeader(hdr http.Header, allowList []string) {
+	keys := make([]string, 0, len(hdr))
 	for key := range hdr {
-		ok := slices.Contains(hdrResCacheList, key)
-		if ok {
-			m.Header = append(m.Header, []string{key, strings.Join(hdr[key], ",")})
+		if slices.Contains(allowList, key) {
+			keys = append(keys, key)
+		}
+	}
+	// map has no order, keep output stable
+	slices.Sort(keys)
+	for _, key := range keys {
+		m.Header = append(m.Header, append([]string{key}, hdr[key]...))
+	}
+}
+
+// GetHeader returns the first cached value of header key, key should be canonical
+func (m *CacheMeta) GetHeader(key string) string {
+	for _, kv := range m.Header {
+		if len(kv) >= 2 && kv[0] == key {
+			return kv[1]
+		}
+	}
+	return ""
+}
+
+// CopyHeader replaces headers in hdr with the cached ones,
+// entries written by old version have one comma joined value
+func (m *CacheMeta) CopyHeader(hdr http.Header, keys ...string) {
+	for _, kv := range m.Header {
+		if len(kv) < 2 {
+			continue
+		}
+		if len(keys) > 0 && !slices.Contains(keys, kv[0]) {
+			continue
+		}
+		hdr.Del(kv[0])
+		for _, v := range kv[1:] {
+			hdr.Add(kv[0], v)
 		}
 	}
 }
 
-func (m *CacheMeta) WriteToFile(fp string) error {
-	fd, err := os.OpenFile(fp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+// buildHeaderList returns canonical header names to be cached.
+// Plain names replace the default list, names start with `+` or `-` add to or remove from it.
+func buildHeaderList(names []string) []string {
+	// JSON config is not filtered by splitList
+	names = slices.DeleteFunc(slices.Clone(names), func(name string) bool { return name == "" })
+	list := slices.Clone(hdrResCacheList)
+	for _, name := range names {
+		if name[0] != '+' && name[0] != '-' {
+			list = nil
+			break
+		}
+	}
+	for _, name := range names {
+		op := name[0]
+		if op == '+' || op == '-' {
+			name = name[1:]
+		}
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if name == "" || slices.Contains(hdrResNeverCacheList, name) {
+			continue
+		}
+		if op == '-' {
+			list = slices.DeleteFunc(list, func(s string) bool { return s == name })
+		} else if !slices.Contains(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// seal records length and checksum of the body written with the meta
+func (m *CacheMeta) seal(value []byte) {
+	m.Size = len(value)
+	m.Checksum = crc32.Checksum(value, crcTable)
+}
+
+// verify reports whether the body is the one recorded by seal
+func (m *CacheMeta) verify(value []byte) bool {
+	return m.Size == len(value) && m.Checksum == crc32.Checksum(value, crcTable)
+}
+
+// WriteToFile replaces the file atomically, see writeFileAtomic
+func (m *CacheMeta) WriteToFile(fp string, fsync bool) error {
+	data, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
-	enc := json.NewEncoder(fd)
-	return enc.Encode(m)
+	return writeFileAtomic(fp, data, fsync)
 }
 
 func (m *CacheMeta) LoadFromFile(fp string) error {
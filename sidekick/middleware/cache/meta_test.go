@@ -0,0 +1,27 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBuildHeaderList(t *testing.T) {
+	if got := buildHeaderList(nil); !slices.Equal(got, hdrResCacheList) {
+		t.Errorf("default = %v", got)
+	}
+	// empty entries from JSON config are skipped
+	if got := buildHeaderList([]string{""}); !slices.Equal(got, hdrResCacheList) {
+		t.Errorf("empty = %v", got)
+	}
+	if got := buildHeaderList([]string{"", "link", "x-custom"}); !slices.Equal(got, []string{"Link", "X-Custom"}) {
+		t.Errorf("replace = %v", got)
+	}
+
+	got := buildHeaderList([]string{"+x-custom", "", "-Server", "+Set-Cookie", "+"})
+	if !slices.Contains(got, "X-Custom") || slices.Contains(got, "Server") || slices.Contains(got, "Set-Cookie") || slices.Contains(got, "") {
+		t.Errorf("add and remove = %v", got)
+	}
+	if len(got) != len(hdrResCacheList) {
+		t.Errorf("len = %v, want %v", len(got), len(hdrResCacheList))
+	}
+}
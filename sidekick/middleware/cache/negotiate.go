@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// server side preference when client accepts them with same weight
+var defaultEncodingPrefer = []string{"zstd", "br", "gzip"}
+
+// parseAcceptEncoding returns the weight of each content coding in Accept-Encoding,
+// names are lower case, `identity` is mapped to `none`
+func parseAcceptEncoding(values []string) map[string]float64 {
+	accept := make(map[string]float64)
+	for _, line := range values {
+		for _, item := range strings.Split(line, ",") {
+			name, params, _ := strings.Cut(item, ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			switch name {
+			case "identity":
+				name = "none"
+			case "x-gzip":
+				name = "gzip"
+			}
+
+			q := 1.0
+			for _, param := range strings.Split(params, ";") {
+				k, v, ok := strings.Cut(param, "=")
+				if !ok || strings.ToLower(strings.TrimSpace(k)) != "q" {
+					continue
+				}
+				w, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil || w < 0 || w > 1 {
+					// invalid weight, ignore the coding
+					q = -1
+				} else {
+					q = w
+				}
+			}
+			if q < 0 {
+				continue
+			}
+			// keep the highest one if listed twice
+			if old, ok := accept[name]; !ok || q > old {
+				accept[name] = q
+			}
+		}
+	}
+	return accept
+}
+
+// negotiateEncoding returns cached content codings acceptable by client as RFC 9110 section 12.5.3,
+// sorted by client weight then prefer, `none` is the last of same weight.
+// Empty if client accepts none of them.
+func negotiateEncoding(values []string, prefer []string) []string {
+	// no Accept-Encoding, only identity is safe to send
+	if len(values) == 0 {
+		return []string{"none"}
+	}
+	accept := parseAcceptEncoding(values)
+
+	weight := func(ce string) float64 {
+		if q, ok := accept[ce]; ok {
+			return q
+		}
+		if q, ok := accept["*"]; ok {
+			return q
+		}
+		// identity is acceptable unless excluded explicitly, but least preferred
+		if ce == "none" {
+			return math.SmallestNonzeroFloat64
+		}
+		return 0
+	}
+	rank := func(ce string) int {
+		if ce == "none" {
+			return len(prefer) + 1
+		}
+		if i := slices.Index(prefer, ce); i >= 0 {
+			return i
+		}
+		return len(prefer)
+	}
+
+	encodings := make([]string, 0, len(CachedContentEncoding))
+	for _, ce := range CachedContentEncoding {
+		if weight(ce) > 0 {
+			encodings = append(encodings, ce)
+		}
+	}
+	slices.SortStableFunc(encodings, func(a, b string) int {
+		if wa, wb := weight(a), weight(b); wa != wb {
+			if wa > wb {
+				return -1
+			}
+			return 1
+		}
+		return rank(a) - rank(b)
+	})
+	return encodings
+}
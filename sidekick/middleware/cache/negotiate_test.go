@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		prefer []string
+		want   []string
+	}{
+		{"no header", nil, nil, []string{"none"}},
+		{"empty header", []string{""}, nil, []string{"none"}},
+		{"ties by server prefer", []string{"gzip, deflate, br"}, nil, []string{"br", "gzip", "none"}},
+		{"all ties", []string{"gzip, br, zstd"}, nil, []string{"zstd", "br", "gzip", "none"}},
+		{"custom prefer", []string{"zstd, br, gzip"}, []string{"gzip", "br"}, []string{"gzip", "br", "zstd", "none"}},
+		{"client weight first", []string{"gzip;q=0.5, br;q=0.8"}, nil, []string{"br", "gzip", "none"}},
+		{"identity excluded", []string{"gzip, identity;q=0"}, nil, []string{"gzip"}},
+		{"identity only", []string{"identity"}, nil, []string{"none"}},
+		{"identity explicit tie is last", []string{"gzip, identity"}, nil, []string{"gzip", "none"}},
+		{"identity preferred by weight", []string{"identity, gzip;q=0.5"}, nil, []string{"none", "gzip"}},
+		{"star excludes all", []string{"*;q=0"}, nil, []string{}},
+		{"star excluded but listed", []string{"*;q=0, gzip"}, nil, []string{"gzip"}},
+		{"star accepts all", []string{"*"}, nil, []string{"zstd", "br", "gzip", "none"}},
+		{"star except one", []string{"br;q=0, *"}, nil, []string{"zstd", "gzip", "none"}},
+		{"x-gzip alias", []string{"x-gzip"}, nil, []string{"gzip", "none"}},
+		{"case insensitive", []string{"GZIP;Q=0.5"}, nil, []string{"gzip", "none"}},
+		{"invalid weight ignored", []string{"gzip;q=2, br"}, nil, []string{"br", "none"}},
+		{"invalid weight text", []string{"gzip;q=abc"}, nil, []string{"none"}},
+		{"multiple header lines", []string{"gzip", "br;q=0.1"}, nil, []string{"gzip", "br", "none"}},
+		{"listed twice keeps highest", []string{"gzip;q=0.1, gzip"}, nil, []string{"gzip", "none"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prefer := tt.prefer
+			if prefer == nil {
+				prefer = defaultEncodingPrefer
+			}
+			if got := negotiateEncoding(tt.values, prefer); !slices.Equal(got, tt.want) {
+				t.Errorf("negotiateEncoding(%q) = %v, want %v", tt.values, got, tt.want)
+			}
+		})
+	}
+}
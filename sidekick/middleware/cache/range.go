@@ -0,0 +1,177 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("range not satisfiable")
+)
+
+// httpRange specifies the byte range to be sent to the client
+type httpRange struct {
+	start, length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// applyRange handles Range and If-Range of the request for a cached 200 response (RFC 9110 section 14),
+// returns the status code and body should be sent, headers for partial content are set.
+// Range with invalid syntax or failed If-Range is ignored and full body is sent.
+func applyRange(r *http.Request, hdr http.Header, cacheMeta *CacheMeta, cacheData []byte) (int, []byte) {
+	rangeHdr := r.Header.Get("Range")
+	if rangeHdr == "" || !checkIfRange(r, cacheMeta) {
+		return http.StatusOK, cacheData
+	}
+
+	size := int64(len(cacheData))
+	ranges, err := parseRange(rangeHdr, size)
+	if errors.Is(err, errNoOverlap) {
+		hdr.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		hdr.Del("Content-Type")
+		return http.StatusRequestedRangeNotSatisfiable, nil
+	}
+	if err != nil || len(ranges) == 0 {
+		return http.StatusOK, cacheData
+	}
+
+	// too many ranges may cost more than the full body, just send all
+	var sum int64
+	for _, ra := range ranges {
+		sum += ra.length
+	}
+	if sum > size {
+		return http.StatusOK, cacheData
+	}
+
+	if len(ranges) == 1 {
+		ra := ranges[0]
+		hdr.Set("Content-Range", ra.contentRange(size))
+		return http.StatusPartialContent, cacheData[ra.start : ra.start+ra.length]
+	}
+
+	contentType := hdr.Get("Content-Type")
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, ra := range ranges {
+		partHdr := textproto.MIMEHeader{}
+		if contentType != "" {
+			partHdr.Set("Content-Type", contentType)
+		}
+		partHdr.Set("Content-Range", ra.contentRange(size))
+		part, err := mw.CreatePart(partHdr)
+		if err != nil {
+			return http.StatusOK, cacheData
+		}
+		part.Write(cacheData[ra.start : ra.start+ra.length])
+	}
+	mw.Close()
+	hdr.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	return http.StatusPartialContent, buf.Bytes()
+}
+
+// checkIfRange reports whether the Range should be applied,
+// If-Range is an entity-tag with strong comparison or a HTTP-date exactly match Last-Modified.
+func checkIfRange(r *http.Request, cacheMeta *CacheMeta) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if tag, _ := scanETag(ir); tag != "" {
+		return matchETag(tag, cacheMeta.GetHeader("Etag"), false)
+	}
+	lastModified := cacheMeta.GetHeader("Last-Modified")
+	if lastModified == "" {
+		return false
+	}
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return lm.Equal(t)
+}
+
+// parseRange parses a Range header string as per RFC 9110 section 14.1.2,
+// unsatisfiable ranges are skipped, errNoOverlap if none of them is satisfiable.
+func parseRange(s string, size int64) ([]httpRange, error) {
+	const b = "bytes="
+	if !strings.HasPrefix(s, b) {
+		return nil, errInvalidRange
+	}
+	var ranges []httpRange
+	noOverlap := false
+	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		start, end, ok := strings.Cut(ra, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		start, end = strings.TrimSpace(start), strings.TrimSpace(end)
+		var r httpRange
+		if start == "" {
+			// suffix-range, last N bytes
+			if end == "" || end[0] == '-' {
+				return nil, errInvalidRange
+			}
+			i, err := strconv.ParseInt(end, 10, 64)
+			if err != nil {
+				return nil, errInvalidRange
+			}
+			if i == 0 || size == 0 {
+				noOverlap = true
+				continue
+			}
+			if i > size {
+				i = size
+			}
+			r.start = size - i
+			r.length = size - r.start
+		} else {
+			i, err := strconv.ParseInt(start, 10, 64)
+			if err != nil || i < 0 {
+				return nil, errInvalidRange
+			}
+			if i >= size {
+				// start beyond the end of body
+				noOverlap = true
+				continue
+			}
+			r.start = i
+			if end == "" {
+				// no end specified, range extends to end of the body
+				r.length = size - r.start
+			} else {
+				i, err := strconv.ParseInt(end, 10, 64)
+				if err != nil || r.start > i {
+					return nil, errInvalidRange
+				}
+				if i >= size {
+					i = size - 1
+				}
+				r.length = i - r.start + 1
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
+	return ranges, nil
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		s    string
+		size int64
+		want []httpRange
+		err  error
+	}{
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, nil},
+		{"bytes=5-", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=-3", 10, []httpRange{{7, 3}}, nil},
+		{"bytes=-20", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=8-20", 10, []httpRange{{8, 2}}, nil},
+		{"bytes= 0-1 , 4-5", 10, []httpRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,,4-5", 10, []httpRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=20-30,0-1", 10, []httpRange{{0, 2}}, nil},
+		{"bytes=10-", 10, nil, errNoOverlap},
+		{"bytes=-0", 10, nil, errNoOverlap},
+		{"bytes=-5", 0, nil, errNoOverlap},
+		{"bytes=0-", 0, nil, errNoOverlap},
+		{"items=0-1", 10, nil, errInvalidRange},
+		{"bytes=5-4", 10, nil, errInvalidRange},
+		{"bytes=a-4", 10, nil, errInvalidRange},
+		{"bytes=-", 10, nil, errInvalidRange},
+		{"bytes=--1", 10, nil, errInvalidRange},
+		{"bytes=1", 10, nil, errInvalidRange},
+		{"bytes=-1-2", 10, nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.s, tt.size)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("parseRange(%q, %d) error = %v, want %v", tt.s, tt.size, err, tt.err)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseRange(%q, %d) = %v, want %v", tt.s, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	const lm = "Tue, 01 Oct 2024 10:00:00 GMT"
+	meta := &CacheMeta{StateCode: 200, Header: [][]string{{"Etag", `"v1"`}, {"Last-Modified", lm}}}
+	weak := &CacheMeta{StateCode: 200, Header: [][]string{{"Etag", `W/"v1"`}}}
+
+	tests := []struct {
+		name string
+		meta *CacheMeta
+		ir   string
+		want bool
+	}{
+		{"no if-range", meta, "", true},
+		{"etag match", meta, `"v1"`, true},
+		{"etag mismatch", meta, `"v0"`, false},
+		{"weak etag never match", weak, `W/"v1"`, false},
+		{"date exact", meta, lm, true},
+		{"date later", meta, "Wed, 02 Oct 2024 10:00:00 GMT", false},
+		{"date invalid", meta, "yesterday", false},
+		{"date without last-modified", weak, lm, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.ir != "" {
+			r.Header.Set("If-Range", tt.ir)
+		}
+		if got := checkIfRange(r, tt.meta); got != tt.want {
+			t.Errorf("%s: checkIfRange() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestApplyRange(t *testing.T) {
+	body := []byte("0123456789")
+	meta := &CacheMeta{StateCode: 200, Header: [][]string{{"Etag", `"v1"`}}}
+
+	tests := []struct {
+		name         string
+		rangeHdr     string
+		ifRange      string
+		code         int
+		body         string
+		contentRange string
+	}{
+		{"no range", "", "", http.StatusOK, "0123456789", ""},
+		{"single", "bytes=2-4", "", http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"suffix", "bytes=-2", "", http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"open end", "bytes=7-", "", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"not satisfiable", "bytes=20-", "", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"invalid ignored", "bytes=x-y", "", http.StatusOK, "0123456789", ""},
+		{"overlapping more than size", "bytes=0-8,1-9", "", http.StatusOK, "0123456789", ""},
+		{"if-range match", "bytes=0-0", `"v1"`, http.StatusPartialContent, "0", "bytes 0-0/10"},
+		{"if-range mismatch", "bytes=0-0", `"v0"`, http.StatusOK, "0123456789", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.rangeHdr != "" {
+				r.Header.Set("Range", tt.rangeHdr)
+			}
+			if tt.ifRange != "" {
+				r.Header.Set("If-Range", tt.ifRange)
+			}
+			hdr := http.Header{"Content-Type": {"text/plain"}}
+			code, data := applyRange(r, hdr, meta, body)
+			if code != tt.code || string(data) != tt.body {
+				t.Errorf("applyRange() = %v %q, want %v %q", code, data, tt.code, tt.body)
+			}
+			if got := hdr.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.contentRange)
+			}
+			if code == http.StatusRequestedRangeNotSatisfiable && hdr.Get("Content-Type") != "" {
+				t.Errorf("Content-Type should be removed with 416")
+			}
+		})
+	}
+}
+
+func TestApplyRangeMultipart(t *testing.T) {
+	body := []byte("0123456789")
+	meta := &CacheMeta{StateCode: 200}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Range", "bytes=0-1,-2")
+	hdr := http.Header{"Content-Type": {"text/plain"}}
+
+	code, data := applyRange(r, hdr, meta, body)
+	if code != http.StatusPartialContent {
+		t.Fatalf("code = %v", code)
+	}
+	mediaType, params, err := mime.ParseMediaType(hdr.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Content-Type = %q", hdr.Get("Content-Type"))
+	}
+
+	want := []struct{ body, contentRange string }{
+		{"01", "bytes 0-1/10"},
+		{"89", "bytes 8-9/10"},
+	}
+	mr := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	for i, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != w.body || part.Header.Get("Content-Range") != w.contentRange || part.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("part %d = %q %v", i, got, part.Header)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("extra part: %v", err)
+	}
+}
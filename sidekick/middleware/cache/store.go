@@ -1,20 +1,32 @@
 package cache
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/maphash"
 	"os"
 	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/puzpuzpuz/xsync"
 	"go.uber.org/zap"
 )
 
 var (
 	ErrCacheExpired  = errors.New("cache expired")
+	ErrCacheStale    = errors.New("cache stale")
 	ErrCacheNotFound = errors.New("key not found in cache")
+	ErrCacheOutdated = errors.New("cache purged after generation")
+	ErrCacheCorrupt  = errors.New("cache body not match meta")
+
+	keyLockSeed = maphash.MakeSeed()
 
 	CachedContentEncoding = []string{
 		"none",
@@ -33,6 +45,39 @@ type Store struct {
 	memMaxSize  int
 	memMaxCount int
 	memCache    atomic.Value // *LRUCache[string, *MemCacheItem]
+
+	// original keys on disk by host directory, for purge by prefix
+	index *xsync.MapOf[string, *diskIndex]
+
+	// only keep this encoding, empty means all encodings
+	storeEncoding string
+	// keep transcoded body in memory
+	transcodeMem bool
+	// flush files to disk on write
+	fsync bool
+
+	// derive other encodings in background
+	encodeQueue chan *encodeJob
+	// source body queued by memory key, skip queue again
+	encodePending *xsync.MapOf[string, *CacheMeta]
+	encodeDropped atomic.Int64
+	done          chan struct{}
+	wg            sync.WaitGroup
+
+	// generation of host directories written or purged, increased by purge and flush of the host.
+	// Generation of a host is the sum with epoch, increased by flush of all hosts.
+	// Writes started in older generation are dropped, so purged content never come back.
+	gens  *xsync.MapOf[string, *hostGen]
+	epoch atomic.Uint64
+
+	// disk writes and removes of one key never interleave
+	keyLocks [KEY_LOCKS]sync.Mutex
+}
+
+type hostGen struct {
+	gen atomic.Uint64
+	// Set holds read lock, generation increased with write lock
+	mu sync.RWMutex
 }
 
 type MemCacheItem struct {
@@ -42,9 +87,19 @@ type MemCacheItem struct {
 
 const (
 	CACHE_DIR = "sidekick-cache"
+
+	// version of the layout on disk, recorded in LAYOUT_FILE
+	CACHE_LAYOUT = "3"
+	LAYOUT_FILE  = ".layout"
+
+	// pseudo content encoding for the variant index of a key
+	VARY_INDEX = "vary"
+
+	// striped locks for disk entries, keys share a lock by hash
+	KEY_LOCKS = 256
 )
 
-func NewStore(loc string, ttl int, memMaxSize int, memMaxCount int, logger *zap.Logger) *Store {
+func NewStore(loc string, ttl int, memMaxSize int, memMaxCount int, storeEncoding string, transcodeMem bool, fsync bool, logger *zap.Logger) *Store {
 	os.MkdirAll(loc+"/"+CACHE_DIR, 0o755)
 	// memCache := xsync.NewMapOf[*MemCacheItem]()
 	d := &Store{
@@ -54,10 +109,29 @@ func NewStore(loc string, ttl int, memMaxSize int, memMaxCount int, logger *zap.
 
 		memMaxSize:  memMaxSize,
 		memMaxCount: memMaxCount,
+
+		storeEncoding: storeEncoding,
+		transcodeMem:  transcodeMem,
+		fsync:         fsync,
+
+		index: xsync.NewMapOf[*diskIndex](),
+		gens:  xsync.NewMapOf[*hostGen](),
+
+		encodeQueue:   make(chan *encodeJob, ENCODE_QUEUE_SIZE),
+		encodePending: xsync.NewMapOf[*CacheMeta](),
+		done:          make(chan struct{}),
 	}
 	memCache := NewLRUCache[string, *MemCacheItem](memMaxCount, memMaxSize)
 	d.memCache.Store(memCache)
 
+	d.migrateLegacy()
+	go d.warmIndex()
+
+	d.wg.Add(ENCODE_WORKERS)
+	for i := 0; i < ENCODE_WORKERS; i++ {
+		go d.encodeWorker()
+	}
+
 	// Load cache from disk
 	/*files, err := os.ReadDir(loc + "/" + CACHE_DIR)
 	if err == nil {
@@ -109,17 +183,70 @@ func (d *Store) getMemCache() *LRUCache[string, *MemCacheItem] {
 	return memCache
 }
 
-func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
-	key = strings.ReplaceAll(key, "/", "+")
-	d.logger.Debug("Getting key from cache", zap.String("key", key), zap.String("ce", ce))
+// hostGeneration returns the generation of the host directory, created if missing,
+// only for writes and purges, any Host header of reads never grows the map
+func (d *Store) hostGeneration(host string) *hostGen {
+	hostPath := hostDir(host)
+	if g, ok := d.gens.Load(hostPath); ok {
+		return g
+	}
+	// not LoadOrCompute, it may store another value than the returned one
+	g, _ := d.gens.LoadOrStore(hostPath, &hostGen{})
+	return g
+}
+
+// Generation returns the current generation of the host, should be taken before running backend for Set.
+// A host never written or purged is at 0 of its own.
+func (d *Store) Generation(host string) uint64 {
+	gen := d.epoch.Load()
+	if g, ok := d.gens.Load(hostDir(host)); ok {
+		gen += g.gen.Load()
+	}
+	return gen
+}
+
+// isGeneration reports whether gen is still current for g, should hold the read lock of g
+func (d *Store) isGeneration(g *hostGen, gen uint64) bool {
+	return gen == d.epoch.Load()+g.gen.Load()
+}
+
+// nextGeneration makes writes of the host started before dropped, returns after running Set done.
+// Empty host means all hosts, a host added to the map while ranging reads the new epoch already.
+func (d *Store) nextGeneration(host string) {
+	if host != "" {
+		d.hostGeneration(host).next()
+		return
+	}
+	d.epoch.Add(1)
+	d.gens.Range(func(_ string, g *hostGen) bool {
+		g.next()
+		return true
+	})
+}
+
+func (g *hostGen) next() {
+	g.mu.Lock()
+	g.gen.Add(1)
+	g.mu.Unlock()
+}
+
+// lockKey returns the lock of the disk entry of the key
+func (d *Store) lockKey(host string, key string) *sync.Mutex {
+	h := maphash.String(keyLockSeed, hostDir(host)+"/"+key)
+	return &d.keyLocks[h%KEY_LOCKS]
+}
+
+func (d *Store) Get(host string, key string, ce string) ([]byte, *CacheMeta, error) {
+	d.logger.Debug("Getting key from cache", zap.String("host", host), zap.String("key", key), zap.String("ce", ce))
 
 	memCache := d.getMemCache()
+	gen := d.Generation(host)
 
 	// load from memory or try load from disk
 	var retErr error
 	var cacheItem *MemCacheItem
 	isDisk := false
-	cacheKey := key + "::" + ce
+	cacheKey := memKey(host, key, ce)
 	for cacheItem == nil && retErr == nil {
 		// not sure why compute function may get called more than once...?
 		cacheItem, _ = memCache.LoadOrCompute(cacheKey, func() (*MemCacheItem, int, bool) {
@@ -127,23 +254,39 @@ func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
 			// retErr = ErrCacheNotFound
 			// return nil, 0, false
 
+			fp := d.entryPath(host, key)
 			cacheMeta := &CacheMeta{}
-			err := cacheMeta.LoadFromFile(path.Join(d.loc, CACHE_DIR, key, ".meta"))
+			err := cacheMeta.LoadFromFile(metaPath(fp, ce))
 			if err != nil {
 				retErr = err
 				return nil, 0, false
 			}
-			value, err := os.ReadFile(path.Join(d.loc, CACHE_DIR, key, "."+ce))
+			if cacheMeta.Key != key {
+				retErr = ErrCacheNotFound
+				return nil, 0, false
+			}
+			value, err := os.ReadFile(path.Join(fp, "."+ce))
+			if errors.Is(err, os.ErrNotExist) {
+				// meta without body, removed by hand or crashed old version
+				err = ErrCacheCorrupt
+			}
 			if err != nil {
 				retErr = err
 				return nil, 0, false
 			}
+			// partly written by old version, or replaced between reading meta and body
+			if !cacheMeta.verify(value) {
+				retErr = ErrCacheCorrupt
+				return nil, 0, false
+			}
+			cacheMeta.contentEncoding = ce
 
 			isDisk = true
+			// purge running, the file may be removed soon, do not keep it in memory
 			return &MemCacheItem{
 				CacheMeta: cacheMeta,
 				value:     value,
-			}, len(value), true // TODO: add header size
+			}, len(value), d.Generation(host) == gen // TODO: add header size
 		})
 		if cacheItem == nil {
 			memCache.Delete(cacheKey)
@@ -151,6 +294,9 @@ func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
 	}
 	if retErr != nil {
 		d.logger.Debug("Error pulled key from disk", zap.String("key", key), zap.String("ce", ce), zap.Error(retErr))
+		if errors.Is(retErr, ErrCacheCorrupt) {
+			d.removeCorrupt(host, key, ce)
+		}
 		return nil, nil, ErrCacheNotFound
 	}
 
@@ -160,11 +306,28 @@ func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
 		d.logger.Debug("Pulled key from memory", zap.String("key", key), zap.String("ce", ce))
 	}
 
-	if d.ttl > 0 {
-		if time.Now().Unix() > cacheItem.Timestamp+int64(d.ttl) {
+	ttl := cacheItem.TTL
+	if ttl == 0 {
+		ttl = d.ttl
+	}
+	if ttl > 0 {
+		expire := cacheItem.Timestamp + int64(ttl)
+		now := time.Now().Unix()
+		if now > expire && now <= expire+int64(cacheItem.StaleTTL) {
+			d.logger.Debug("Cache stale", zap.String("key", key))
+			return cacheItem.value, cacheItem.CacheMeta, ErrCacheStale
+		}
+		// keep for stale-if-error, only served when upstream failed
+		if now > expire && now <= expire+int64(cacheItem.StaleErrorTTL) {
+			d.logger.Debug("Cache expired, keep for error", zap.String("key", key))
+			return cacheItem.value, cacheItem.CacheMeta, ErrCacheExpired
+		}
+		if now > expire {
 			d.logger.Debug("Cache expired", zap.String("key", key))
-			// TODO: fix racing when purge running and setting new value with same key
-			go d.Purge(key)
+			// only the one removed it from memory cleans the disk, others just miss
+			if memCache.CompareAndDelete(cacheKey, cacheItem) {
+				go d.removeExpired(host, key, ce, cacheItem)
+			}
 			return nil, nil, ErrCacheExpired
 		}
 	}
@@ -173,47 +336,293 @@ func (d *Store) Get(key string, ce string) ([]byte, *CacheMeta, error) {
 	return cacheItem.value, cacheItem.CacheMeta, nil
 }
 
-func (d *Store) Set(reqPath string, cacheKey string, meta *CacheMeta, value []byte) error {
-	key := d.buildCacheKey(reqPath, cacheKey)
-	d.logger.Debug("Cache Key", zap.String("Key", key), zap.String("ce", meta.contentEncoding))
+// Set stores the value, dropped if purged or flushed after gen taken
+func (d *Store) Set(host string, key string, gen uint64, meta *CacheMeta, value []byte) error {
+	d.logger.Debug("Cache Key", zap.String("host", host), zap.String("Key", key), zap.String("ce", meta.contentEncoding))
+
+	hg := d.hostGeneration(host)
+	hg.mu.RLock()
+	defer hg.mu.RUnlock()
+	if !d.isGeneration(hg, gen) {
+		d.logger.Debug("Drop cache from older generation", zap.String("host", host), zap.String("key", key), zap.String("ce", meta.contentEncoding))
+		return ErrCacheOutdated
+	}
 
-	key = strings.ReplaceAll(key, "/", "+")
 	ce := meta.contentEncoding
+	meta.Key = key
 	memCache := d.getMemCache()
+	basePath := d.entryPath(host, key)
+
+	mu := d.lockKey(host, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// derived from a body replaced while compressing, the newer one has its own job
+	if meta.source != nil && !d.isSource(host, key, meta.source) {
+		d.logger.Debug("Drop cache derived from replaced body", zap.String("host", host), zap.String("key", key), zap.String("ce", ce))
+		return ErrCacheOutdated
+	}
+
 	// _, existed := memCache.LoadAndStore(key+"::"+ce, &MemCacheItem{
 	// 	CacheMeta: meta,
 	// 	value:     value,
 	// })
-	existed := memCache.Put(key+"::"+ce, &MemCacheItem{
+	existed := memCache.Put(memKey(host, key, ce), &MemCacheItem{
 		CacheMeta: meta,
 		value:     value,
 	}, len(value)) // TODO: add header size
 
+	// new body from backend, drop other encodings of the old one,
+	// or clients accepting them keep getting the old body until derived again
+	if meta.source == nil && ce != VARY_INDEX {
+		for _, other := range CachedContentEncoding {
+			if other != ce {
+				memCache.Delete(memKey(host, key, other))
+				d.removeDisk(basePath, key, other)
+			}
+		}
+	}
+
 	d.logger.Debug("-----------------------------------")
-	d.logger.Debug("Setting key in cache", zap.String("key", key), zap.String("ce", meta.contentEncoding), zap.Bool("replace", existed))
+	d.logger.Debug("Setting key in cache", zap.String("host", host), zap.String("key", key), zap.String("ce", meta.contentEncoding), zap.Bool("replace", existed))
 
 	// create page directory
-	basePath := path.Join(d.loc, CACHE_DIR, key)
 	os.MkdirAll(basePath, 0o755)
-	err := os.WriteFile(path.Join(basePath, "."+ce), value, 0o644)
+	// body and meta replaced one by one, loader rejects the pair not sealed together
+	meta.seal(value)
+	err := writeFileAtomic(path.Join(basePath, "."+ce), value, d.fsync)
 	if err != nil {
 		d.logger.Error("Error writing data to cache", zap.Error(err))
-	}
-	err = meta.WriteToFile(path.Join(basePath, ".meta"))
-	if err != nil {
+	} else if err = meta.WriteToFile(metaPath(basePath, ce), d.fsync); err != nil {
 		d.logger.Error("Error writing meta to cache", zap.Error(err))
+	} else {
+		d.hostIndex(hostDir(host)).keys.Store(key, struct{}{})
+	}
+
+	// other encodings are derived from the body, so backend runs once for all clients
+	if ce != VARY_INDEX && meta.source == nil {
+		d.queueEncode(host, key, ce, gen, meta, value)
 	}
 	return nil
 }
 
-func (d *Store) Purge(key string) {
-	key = strings.ReplaceAll(key, "/", "+")
-	d.logger.Debug("Removing key from cache", zap.String("key", key))
+// GetTranscoded returns the body stored in the encoding `from` converted to `to`,
+// error is same as Get.
+func (d *Store) GetTranscoded(host string, key string, from string, to string) ([]byte, *CacheMeta, error) {
+	gen := d.Generation(host)
+	value, meta, err := d.Get(host, key, from)
+	if value == nil {
+		return nil, nil, err
+	}
+	converted, cerr := transcode(from, to, value)
+	if cerr != nil {
+		d.logger.Error("Error transcoding cache", zap.String("key", key), zap.String("from", from), zap.String("to", to), zap.Error(cerr))
+		return nil, nil, ErrCacheNotFound
+	}
+	meta = meta.derive(to, converted)
+	if err == nil && d.transcodeMem {
+		hg := d.hostGeneration(host)
+		hg.mu.RLock()
+		if d.isGeneration(hg, gen) {
+			d.getMemCache().Put(memKey(host, key, to), &MemCacheItem{
+				CacheMeta: meta,
+				value:     converted,
+			}, len(converted))
+		}
+		hg.mu.RUnlock()
+	}
+	return converted, meta, err
+}
+
+// Close stops background workers, pending jobs are dropped
+func (d *Store) Close() {
+	close(d.done)
+	d.wg.Wait()
+}
 
+// GetVary returns the Vary header names recorded for the primary key,
+// nil if the response of the key has no Vary
+func (d *Store) GetVary(host string, key string) []string {
+	_, meta, err := d.Get(host, key, VARY_INDEX)
+	if err != nil {
+		return nil
+	}
+	return meta.Vary
+}
+
+// PeekVary returns the Vary header names recorded for the primary key in memory only,
+// nil if not in memory, lookup goes to the variant without trying the primary key on disk
+func (d *Store) PeekVary(host string, key string) []string {
+	item, ok := d.getMemCache().Peek(memKey(host, key, VARY_INDEX))
+	if !ok {
+		return nil
+	}
+	return (*item).Vary
+}
+
+// SetVary records the Vary header names for the primary key.
+// With Vary, every variant stored as a key suffixed by `#<hash of request headers>`,
+// the entries of the primary key itself are removed.
+// Without Vary, the index and the variants are removed.
+func (d *Store) SetVary(host string, key string, gen uint64, vary []string) {
+	if gen != d.Generation(host) {
+		return
+	}
+	if len(vary) == 0 {
+		if old := d.GetVary(host, key); len(old) > 0 {
+			d.remove(host, key, VARY_INDEX)
+			d.dropVariants(host, key)
+		}
+		return
+	}
+
+	if old := d.GetVary(host, key); slices.Equal(old, vary) {
+		return
+	}
+	for _, ce := range CachedContentEncoding {
+		d.remove(host, key, ce)
+	}
+	// index never expire, variants expire by themselves
+	d.Set(host, key, gen, &CacheMeta{
+		Timestamp: time.Now().Unix(),
+		TTL:       -1,
+		Vary:      vary,
+
+		contentEncoding: VARY_INDEX,
+	}, nil)
+}
+
+// dropVariants removes every variant of the primary key, after its response has no Vary any more
+func (d *Store) dropVariants(host string, key string) {
+	prefix := key + "#"
+	hostPath := hostDir(host)
+	idx := d.loadIndex(hostPath)
+	for _, k := range idx.match(prefix) {
+		mu := d.lockKey(host, k)
+		mu.Lock()
+		idx.keys.Delete(k)
+		fp := d.entryDir(hostPath, k)
+		if err := os.RemoveAll(fp); err != nil {
+			d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
+		}
+		mu.Unlock()
+	}
+	d.purgeMem(host, prefix)
+}
+
+// remove deletes one encoding of the key from memory and disk
+func (d *Store) remove(host string, key string, ce string) {
+	d.getMemCache().Delete(memKey(host, key, ce))
+	mu := d.lockKey(host, key)
+	mu.Lock()
+	if d.removeDisk(d.entryPath(host, key), key, ce) {
+		d.unindexEmpty(host, key)
+	}
+	mu.Unlock()
+}
+
+// removeDisk deletes one encoding of the entry, meta first so the body is never loaded again.
+// Reports whether the meta existed.
+// Should hold the lock of the key, except in migration.
+func (d *Store) removeDisk(fp string, key string, ce string) bool {
+	removed := false
+	for i, name := range []string{metaPath(fp, ce), path.Join(fp, "."+ce)} {
+		err := os.Remove(name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			d.logger.Error("Error Removing key from disk cache", zap.String("key", key), zap.String("ce", ce), zap.Error(err))
+		}
+		if i == 0 && err == nil {
+			removed = true
+		}
+	}
+	return removed
+}
+
+// unindexEmpty drops the key from the index and its directory once no encoding left,
+// or every query string and variant ever expired stays in memory.
+// Should hold the lock of the key.
+func (d *Store) unindexEmpty(host string, key string) {
+	fp := d.entryPath(host, key)
+	if loadEntryMeta(fp) != nil {
+		return
+	}
+	d.hostIndex(hostDir(host)).keys.Delete(key)
+	// fails if not empty, like temp file of a crashed write
+	os.Remove(fp)
+}
+
+// removeExpired deletes the expired entry on disk, unless it is replaced already
+func (d *Store) removeExpired(host string, key string, ce string, item *MemCacheItem) {
+	mu := d.lockKey(host, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	fp := d.entryPath(host, key)
+	meta := &CacheMeta{}
+	if err := meta.LoadFromFile(metaPath(fp, ce)); err != nil {
+		return
+	}
+	if meta.Key != key || meta.Timestamp != item.Timestamp {
+		return
+	}
+	if d.removeDisk(fp, key, ce) {
+		d.unindexEmpty(host, key)
+	}
+}
+
+// removeCorrupt deletes the entry on disk not matching its meta,
+// checked again under the lock of the key, the pair may be just replaced by Set
+func (d *Store) removeCorrupt(host string, key string, ce string) {
+	mu := d.lockKey(host, key)
+	mu.Lock()
+	defer mu.Unlock()
+
+	fp := d.entryPath(host, key)
+	meta := &CacheMeta{}
+	if err := meta.LoadFromFile(metaPath(fp, ce)); err != nil || meta.Key != key {
+		return
+	}
+	value, err := os.ReadFile(path.Join(fp, "."+ce))
+	if err == nil && meta.verify(value) {
+		return
+	}
+	d.logger.Warn("wp cache - remove corrupt entry", zap.String("host", host), zap.String("key", key), zap.String("ce", ce))
+	if d.removeDisk(fp, key, ce) {
+		d.unindexEmpty(host, key)
+	}
+}
+
+// Purge removes all keys with the prefix, empty host means all hosts.
+// Writes started before are dropped, so after return the purged content never come back.
+func (d *Store) Purge(host string, key string) {
+	d.logger.Debug("Removing key from cache", zap.String("host", host), zap.String("key", key))
+
+	d.nextGeneration(host)
+
+	// key is hashed on disk, find the original keys in the index
+	for _, hostPath := range d.listHostDirs(host) {
+		idx := d.loadIndex(hostPath)
+		for _, k := range idx.match(key) {
+			// out of index first, a Set after it adds the key back
+			idx.keys.Delete(k)
+			fp := d.entryDir(hostPath, k)
+			err := os.RemoveAll(fp)
+			if err != nil {
+				d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
+			}
+		}
+	}
+
+	// disk loaded to memory while removing is dropped by generation too
+	d.nextGeneration(host)
+	d.purgeMem(host, key)
+}
+
+func (d *Store) purgeMem(host string, key string) {
 	memCache := d.getMemCache()
 	rmKeys := make([]string, 0, 4)
 	memCache.Range(func(k string, v *MemCacheItem) bool {
-		if strings.HasPrefix(k, key) {
+		if matchMemKey(k, host, key) {
 			rmKeys = append(rmKeys, k)
 		}
 		return true
@@ -222,35 +631,32 @@ func (d *Store) Purge(key string) {
 		d.logger.Debug("Removing key from mem cache", zap.String("key", k))
 		memCache.Delete(k)
 	}
+}
 
-	basePath := path.Join(d.loc, CACHE_DIR)
-	files, err := os.ReadDir(basePath)
-	if err != nil {
-		d.logger.Error("Error Removing key from disk cache", zap.Error(err))
-		return
-	}
-	for _, f := range files {
-		name := f.Name()
-		if !strings.HasPrefix(name, key) {
-			continue
+// Flush removes all keys of the host, empty host means all hosts
+// Same as Purge, writes started before are dropped.
+func (d *Store) Flush(host string) error {
+	d.nextGeneration(host)
+	// same order as Purge, disk then memory
+	defer func() {
+		d.dropIndex(host)
+		d.nextGeneration(host)
+		if host != "" {
+			d.purgeMem(host, "")
+		} else {
+			d.memCache.Store(NewLRUCache[string, *MemCacheItem](d.memMaxCount, d.memMaxSize))
 		}
-		fp := path.Join(basePath, name)
+	}()
+
+	if host != "" {
+		fp := path.Join(d.loc, CACHE_DIR, hostDir(host))
 		err := os.RemoveAll(fp)
 		if err != nil {
-			d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
+			d.logger.Error("Error flushing cache", zap.String("fp", fp), zap.Error(err))
 		}
-		// for _, name := range CachedContentEncoding {
-		// 	err := os.Remove(path.Join(fp, "."+name))
-		// 	if err != nil {
-		// 		d.logger.Error("Error Removing key from disk cache", zap.String("fp", fp), zap.Error(err))
-		// 	}
-		// }
+		return err
 	}
-}
 
-func (d *Store) Flush() error {
-	d.memCache.Store(NewLRUCache[string, *MemCacheItem](d.memMaxCount, d.memMaxSize))
-	// return nil
 	basePath := path.Join(d.loc, CACHE_DIR)
 	files, err := os.ReadDir(basePath)
 	if err != nil {
@@ -258,6 +664,10 @@ func (d *Store) Flush() error {
 		return err
 	}
 	for _, f := range files {
+		// keep the layout marker, or the next start scans for migration again
+		if f.Name() == LAYOUT_FILE {
+			continue
+		}
 		fp := path.Join(basePath, f.Name())
 		err = os.RemoveAll(fp)
 		if err != nil {
@@ -267,49 +677,274 @@ func (d *Store) Flush() error {
 	return err
 }
 
-func (d *Store) List() map[string][]string {
+// List returns all keys of the host, empty host means all hosts
+func (d *Store) List(host string) map[string][]string {
 	memCache := d.getMemCache()
 	list := make(map[string][]string)
 	list["mem"] = make([]string, 0, memCache.Size())
 
 	memCache.Range(func(key string, value *MemCacheItem) bool {
-		list["mem"] = append(list["mem"], key)
+		if matchMemKey(key, host, "") {
+			list["mem"] = append(list["mem"], key)
+		}
 		return true
 	})
 
-	basePath := path.Join(d.loc, CACHE_DIR)
-	files, err := os.ReadDir(basePath)
 	list["disk"] = make([]string, 0)
-
-	if err == nil {
-		for _, file := range files {
-			if !file.IsDir() {
+	d.walkDisk(host, func(hostPath string, fp string, meta *CacheMeta) {
+		for _, name := range CachedContentEncoding {
+			ckPath := metaPath(fp, name)
+			_, err := os.Stat(ckPath)
+			if errors.Is(err, os.ErrNotExist) {
 				continue
 			}
-			dirName := file.Name()
-			fp := path.Join(basePath, dirName)
-			for _, name := range CachedContentEncoding {
-				ckPath := path.Join(fp, "."+name)
-				_, err := os.Stat(ckPath)
-				if errors.Is(err, os.ErrNotExist) {
-					continue
-				}
-				list["disk"] = append(list["disk"], dirName+"::"+name)
-			}
+			list["disk"] = append(list["disk"], hostPath+"/"+meta.Key+"::"+name)
 		}
-	}
+	})
 
 	list["debug"] = []string{
 		fmt.Sprintf("max_size=%v", d.memMaxSize),
 		fmt.Sprintf("max_count=%v", d.memMaxCount),
 		fmt.Sprintf("size=%v", memCache.Cost()),
 		fmt.Sprintf("coun=%v", memCache.Size()),
+		fmt.Sprintf("encode_queue=%v/%v", len(d.encodeQueue), cap(d.encodeQueue)),
+		fmt.Sprintf("encode_dropped=%v", d.encodeDropped.Load()),
 	}
 
 	return list
 }
 
+// listHostDirs returns the directory of the host, or all host directories if host is empty
+func (d *Store) listHostDirs(host string) []string {
+	if host != "" {
+		return []string{hostDir(host)}
+	}
+	files, err := os.ReadDir(path.Join(d.loc, CACHE_DIR))
+	if err != nil {
+		return nil
+	}
+	dirs := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), "+") {
+			dirs = append(dirs, f.Name())
+		}
+	}
+	return dirs
+}
+
+// walkDisk calls fn for every entry directory of the host on disk,
+// empty host means all hosts
+func (d *Store) walkDisk(host string, fn func(hostPath string, fp string, meta *CacheMeta)) {
+	for _, hostPath := range d.listHostDirs(host) {
+		d.walkHostDir(hostPath, fn)
+	}
+}
+
+// walkHostDir calls fn for every entry directory in the host directory
+func (d *Store) walkHostDir(hostPath string, fn func(hostPath string, fp string, meta *CacheMeta)) {
+	basePath := path.Join(d.loc, CACHE_DIR, hostPath)
+	shards1, err := os.ReadDir(basePath)
+	if err != nil {
+		return
+	}
+	for _, s1 := range shards1 {
+		shards2, err := os.ReadDir(path.Join(basePath, s1.Name()))
+		if err != nil {
+			continue
+		}
+		for _, s2 := range shards2 {
+			shardPath := path.Join(basePath, s1.Name(), s2.Name())
+			entries, err := os.ReadDir(shardPath)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				fp := path.Join(shardPath, entry.Name())
+				meta := loadEntryMeta(fp)
+				if meta == nil {
+					continue
+				}
+				fn(hostPath, fp, meta)
+			}
+		}
+	}
+}
+
+// loadEntryMeta returns any meta of the entry directory, for the key of the entry
+func loadEntryMeta(fp string) *CacheMeta {
+	files, err := os.ReadDir(fp)
+	if err != nil {
+		return nil
+	}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, ".meta") || strings.HasPrefix(name, TEMP_PREFIX) {
+			continue
+		}
+		meta := &CacheMeta{}
+		if err := meta.LoadFromFile(path.Join(fp, name)); err == nil {
+			return meta
+		}
+	}
+	return nil
+}
+
+// metaPath returns the meta file of one encoding in the entry directory,
+// every encoding has its own meta, so body and meta always match
+func metaPath(fp string, ce string) string {
+	return path.Join(fp, "."+ce+".meta")
+}
+
+// entryPath returns the directory of the key on disk.
+// Key is hashed, so any key is a safe and short name, and sharded by 2 levels
+// to keep directories small: `<host>/ab/cd/abcd...`
+func (d *Store) entryPath(host string, key string) string {
+	return d.entryDir(hostDir(host), key)
+}
+
+// entryDir is entryPath with the host directory name
+func (d *Store) entryDir(hostPath string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	return path.Join(d.loc, CACHE_DIR, hostPath, h[0:2], h[2:4], h)
+}
+
+// migrateLegacy moves entries of the old flat layout (`sidekick-cache/+path+::/`)
+// into the hashed layout of the shared host "_", which is read with `ignore_host`.
+// Then splits the shared meta of layout 2 into the meta of every encoding.
+// Only run once, the `.layout` file marks the migration done.
+func (d *Store) migrateLegacy() {
+	basePath := path.Join(d.loc, CACHE_DIR)
+	marker := path.Join(basePath, LAYOUT_FILE)
+	layout, err := os.ReadFile(marker)
+	if err == nil && string(layout) == CACHE_LAYOUT {
+		return
+	}
+	if err == nil {
+		d.splitMeta()
+		d.writeLayout(marker)
+		return
+	}
+
+	files, err := os.ReadDir(basePath)
+	if err != nil {
+		return
+	}
+	count := 0
+	for _, f := range files {
+		name := f.Name()
+		if !f.IsDir() || !strings.HasPrefix(name, "+") {
+			continue
+		}
+		oldPath := path.Join(basePath, name)
+		meta := &CacheMeta{}
+		if err := meta.LoadFromFile(path.Join(oldPath, ".meta")); err != nil {
+			os.RemoveAll(oldPath)
+			continue
+		}
+
+		// old layout replaced "/" with "+", so "+" in the original path is lost
+		meta.Key = strings.ReplaceAll(name, "+", "/")
+		newPath := d.entryPath("", meta.Key)
+		os.MkdirAll(path.Dir(newPath), 0o755)
+		os.RemoveAll(newPath)
+		if err := os.Rename(oldPath, newPath); err != nil {
+			d.logger.Error("Error migrating cache", zap.String("fp", oldPath), zap.Error(err))
+			os.RemoveAll(oldPath)
+			continue
+		}
+		// sealed by encoding in splitMeta
+		if err := meta.WriteToFile(path.Join(newPath, ".meta"), false); err != nil {
+			d.logger.Error("Error migrating cache", zap.String("fp", newPath), zap.Error(err))
+			os.RemoveAll(newPath)
+			continue
+		}
+		count++
+	}
+	if count > 0 {
+		d.logger.Info("Migrated cache to hashed layout", zap.Int("count", count))
+	}
+
+	d.splitMeta()
+	d.writeLayout(marker)
+}
+
+func (d *Store) writeLayout(marker string) {
+	err := writeFileAtomic(marker, []byte(CACHE_LAYOUT), d.fsync)
+	if err != nil {
+		d.logger.Error("Error writing cache layout", zap.Error(err))
+	}
+}
+
+// splitMeta converts entries of layout 2, which have one `.meta` shared by all encodings,
+// every body gets its own sealed meta. The vary index is told apart by the missing status code.
+func (d *Store) splitMeta() {
+	count := 0
+	d.walkDisk("", func(hostPath string, fp string, _ *CacheMeta) {
+		shared := path.Join(fp, ".meta")
+		meta := &CacheMeta{}
+		if err := meta.LoadFromFile(shared); err != nil {
+			return
+		}
+		for _, ce := range append(slices.Clone(CachedContentEncoding), VARY_INDEX) {
+			value, err := os.ReadFile(path.Join(fp, "."+ce))
+			if err != nil {
+				continue
+			}
+			if (ce == VARY_INDEX) != (meta.StateCode == 0) {
+				d.removeDisk(fp, meta.Key, ce)
+				continue
+			}
+			m := *meta
+			m.seal(value)
+			if err := m.WriteToFile(metaPath(fp, ce), false); err != nil {
+				d.logger.Error("Error migrating cache", zap.String("fp", fp), zap.Error(err))
+				d.removeDisk(fp, meta.Key, ce)
+			}
+		}
+		os.Remove(shared)
+		count++
+	})
+	if count > 0 {
+		d.logger.Info("Migrated cache to meta by encoding", zap.Int("count", count))
+	}
+}
+
 func (d *Store) buildCacheKey(reqPath string, cacheKey string) string {
 	// cacheKey := contentEncoding + "::" + reqPath
 	return fmt.Sprintf("%v::%v", reqPath, cacheKey)
 }
+
+var hostDirRx = regexp.MustCompile(`^[a-z0-9][a-z0-9.\-]*$`)
+
+// hostDir returns the namespace of the host, used as directory name on disk
+// and as prefix of memory cache key.
+// Empty host (shared by all hosts) is "_", weird hosts are hashed to keep them safe as path.
+func hostDir(host string) string {
+	if host == "" {
+		return "_"
+	}
+	if hostDirRx.MatchString(host) {
+		return host
+	}
+	sum := sha256.Sum256([]byte(host))
+	return "_" + hex.EncodeToString(sum[:8])
+}
+
+// memKey returns the memory cache key
+func memKey(host string, key string, ce string) string {
+	return hostDir(host) + "/" + key + "::" + ce
+}
+
+// matchMemKey reports whether the memory cache key belongs to the host and has the prefix,
+// empty host match all hosts
+func matchMemKey(memKey string, host string, prefix string) bool {
+	hostPath, key, ok := strings.Cut(memKey, "/")
+	if !ok {
+		return false
+	}
+	if host != "" && hostPath != hostDir(host) {
+		return false
+	}
+	return strings.HasPrefix(key, prefix)
+}
@@ -0,0 +1,278 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSetDropsOldEncodings(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	hdr := http.Header{"Content-Type": {"text/html"}}
+
+	d.Set("example.com", "/a/::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), []byte(strings.Repeat("old page ", 100)))
+	// compressed in background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, _, err := d.Get("example.com", "/a/::", "gzip"); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("gzip never derived")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// too small to compress, old variants must not be served
+	d.Set("example.com", "/a/::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), []byte("new"))
+	for _, ce := range []string{"gzip", "br", "zstd"} {
+		if _, _, err := d.Get("example.com", "/a/::", ce); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("%v still cached: %v", ce, err)
+		}
+		if _, err := os.Stat(path.Join(d.entryPath("example.com", "/a/::"), "."+ce)); err == nil {
+			t.Errorf("%v still on disk", ce)
+		}
+	}
+	if v, _, err := d.Get("example.com", "/a/::", "none"); err != nil || string(v) != "new" {
+		t.Errorf("none = %q %v", v, err)
+	}
+}
+
+func TestIndexDropsRemovedKeys(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	hdr := http.Header{"Content-Type": {"text/html"}}
+	indexed := func(key string) bool {
+		_, ok := d.loadIndex("example.com").keys.Load(key)
+		return ok
+	}
+
+	// removed one by one, dropped with the last encoding
+	d.Set("example.com", "/a/?s=1::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), []byte("a"))
+	d.SetVary("example.com", "/a/?s=1::", d.Generation("example.com"), []string{"Accept-Language"})
+	d.remove("example.com", "/a/?s=1::", "none")
+	if !indexed("/a/?s=1::") {
+		t.Error("dropped with vary index left")
+	}
+	d.remove("example.com", "/a/?s=1::", VARY_INDEX)
+	if indexed("/a/?s=1::") {
+		t.Error("still indexed after all removed")
+	}
+	if _, err := os.Stat(d.entryPath("example.com", "/a/?s=1::")); err == nil {
+		t.Error("empty directory left")
+	}
+
+	// expired on read
+	meta := NewCacheMeta(200, hdr, hdrResCacheList)
+	meta.Timestamp -= 10
+	meta.TTL = 1
+	d.Set("example.com", "/b/?s=2::", d.Generation("example.com"), meta, []byte("b"))
+	if !indexed("/b/?s=2::") {
+		t.Fatal("not indexed after Set")
+	}
+	if _, _, err := d.Get("example.com", "/b/?s=2::", "none"); !errors.Is(err, ErrCacheExpired) {
+		t.Fatalf("Get = %v, want expired", err)
+	}
+	waitFor(t, "expired key unindexed", func() bool { return !indexed("/b/?s=2::") })
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	loc := t.TempDir()
+	old := path.Join(loc, CACHE_DIR, "+a+b+::")
+	os.MkdirAll(old, 0o755)
+	os.WriteFile(path.Join(old, ".meta"), []byte(fmt.Sprintf(`{"c":200,"h":[["Content-Type","text/html"]],"t":%d}`, time.Now().Unix())), 0o644)
+	os.WriteFile(path.Join(old, ".none"), []byte("legacy page"), 0o644)
+
+	d := NewStore(loc, 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	value, meta, err := d.Get("", "/a/b/::", "none")
+	if err != nil || string(value) != "legacy page" || meta.Key != "/a/b/::" {
+		t.Fatalf("Get = %q %v", value, err)
+	}
+	if _, err := os.Stat(old); err == nil {
+		t.Error("legacy directory left")
+	}
+	if layout, _ := os.ReadFile(path.Join(loc, CACHE_DIR, LAYOUT_FILE)); string(layout) != CACHE_LAYOUT {
+		t.Errorf("layout = %q", layout)
+	}
+}
+
+func TestSetDroppedAfterPurge(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	hdr := http.Header{"Content-Type": {"text/html"}}
+
+	// reads of unknown hosts never add generations
+	d.Get("random.example", "/::", "none")
+	d.Generation("other.example")
+	if n := d.gens.Size(); n != 0 {
+		t.Errorf("gens = %v after reads", n)
+	}
+
+	for _, purge := range []struct {
+		name string
+		fn   func()
+	}{
+		{"purge", func() { d.Purge("example.com", "/a/") }},
+		{"flush host", func() { d.Flush("example.com") }},
+		{"flush all", func() { d.Flush("") }},
+	} {
+		// the backend started before the purge
+		gen := d.Generation("example.com")
+		purge.fn()
+		err := d.Set("example.com", "/a/::", gen, NewCacheMeta(200, hdr, hdrResCacheList), []byte("old"))
+		if !errors.Is(err, ErrCacheOutdated) {
+			t.Errorf("%v: Set = %v", purge.name, err)
+		}
+		if _, _, err := d.Get("example.com", "/a/::", "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("%v: Get = %v", purge.name, err)
+		}
+		if _, err := os.Stat(metaPath(d.entryPath("example.com", "/a/::"), "none")); err == nil {
+			t.Errorf("%v: written to disk", purge.name)
+		}
+	}
+
+	// flush of all hosts drops a host never seen before
+	gen := d.Generation("new.example")
+	d.Flush("")
+	if err := d.Set("new.example", "/::", gen, NewCacheMeta(200, hdr, hdrResCacheList), []byte("old")); !errors.Is(err, ErrCacheOutdated) {
+		t.Errorf("new host: Set = %v", err)
+	}
+}
+
+func TestDeriveDroppedAfterPurge(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	hdr := http.Header{"Content-Type": {"text/html"}}
+	page := []byte(strings.Repeat("page to compress ", 100))
+
+	gen := d.Generation("example.com")
+	meta := NewCacheMeta(200, hdr, hdrResCacheList)
+	d.Set("example.com", "/a/::", gen, meta, page)
+	d.Purge("example.com", "/a/")
+	// compressing since before the purge, the source still looks current
+	d.getMemCache().Put(memKey("example.com", "/a/::", "none"), &MemCacheItem{CacheMeta: meta, value: page}, len(page))
+	d.encode(newEncoder(false), &encodeJob{host: "example.com", key: "/a/::", ce: "none", gen: gen, meta: meta, value: page})
+	// wait for the job queued by Set
+	d.Close()
+
+	for _, ce := range []string{"gzip", "br", "zstd"} {
+		if _, ok := d.getMemCache().Peek(memKey("example.com", "/a/::", ce)); ok {
+			t.Errorf("%v in memory", ce)
+		}
+		if _, err := os.Stat(metaPath(d.entryPath("example.com", "/a/::"), ce)); err == nil {
+			t.Errorf("%v on disk", ce)
+		}
+	}
+}
+
+func TestDiskLoadRacingFlush(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	hdr := http.Header{"Content-Type": {"text/html"}}
+
+	for i := 0; i < 50; i++ {
+		d.Set("example.com", "/a/::", d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), []byte("old"))
+		// only on disk, every Get loads it
+		d.memCache.Store(NewLRUCache[string, *MemCacheItem](100, 1<<20))
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for g := 0; g < 4; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						d.Get("example.com", "/a/::", "none")
+					}
+				}
+			}()
+		}
+
+		d.Flush("example.com")
+		// loads racing the flush are never kept, nothing served after return
+		if _, ok := d.getMemCache().Peek(memKey("example.com", "/a/::", "none")); ok {
+			t.Fatalf("round %v: in memory after flush", i)
+		}
+		if _, _, err := d.Get("example.com", "/a/::", "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Fatalf("round %v: Get = %v", i, err)
+		}
+		close(stop)
+		wg.Wait()
+	}
+}
+
+func TestGetRejectsCorrupt(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	hdr := http.Header{"Content-Type": {"text/html"}}
+
+	for name, damage := range map[string]func(fp string){
+		"truncated": func(fp string) { os.Truncate(fp, 3) },
+		"flipped":   func(fp string) { os.WriteFile(fp, []byte("page of same length XX"), 0o644) },
+		"missing":   func(fp string) { os.Remove(fp) },
+	} {
+		key := "/" + name + "/::"
+		body := []byte("page of same length ok")
+		d.Set("example.com", key, d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), body)
+		// only on disk
+		d.getMemCache().Delete(memKey("example.com", key, "none"))
+		fp := d.entryPath("example.com", key)
+		damage(path.Join(fp, ".none"))
+
+		if value, _, err := d.Get("example.com", key, "none"); !errors.Is(err, ErrCacheNotFound) {
+			t.Errorf("%v: Get = %q %v", name, value, err)
+		}
+		if _, err := os.Stat(metaPath(fp, "none")); err == nil {
+			t.Errorf("%v: meta left on disk", name)
+		}
+		if _, ok := d.loadIndex("example.com").keys.Load(key); ok {
+			t.Errorf("%v: still indexed", name)
+		}
+	}
+}
+
+func TestSetVaryDropsVariants(t *testing.T) {
+	d := NewStore(t.TempDir(), 0, 1<<20, 100, "", false, false, zap.NewNop())
+	defer d.Close()
+	c := &Cache{Store: d}
+	hdr := http.Header{"Content-Type": {"text/html"}}
+	r, _ := http.NewRequest("GET", "http://example.com/a/", nil)
+	r.Header.Set("Accept-Language", "de")
+	variant := variantKey("/a/::", []string{"Accept-Language"}, r.Header)
+
+	d.SetVary("example.com", "/a/::", d.Generation("example.com"), []string{"Accept-Language"})
+	d.Set("example.com", variant, d.Generation("example.com"), NewCacheMeta(200, hdr, hdrResCacheList), []byte("de"))
+	// left by a race, never tried first when the index is in memory
+	d.getMemCache().Put(memKey("example.com", "/a/::", "none"), &MemCacheItem{CacheMeta: NewCacheMeta(200, hdr, hdrResCacheList), value: []byte("primary")}, 7)
+	if value, _, _, err := c.lookup(r, "example.com", "/a/::", []string{"none"}); err != nil || string(value) != "de" {
+		t.Errorf("lookup = %q %v, want the variant", value, err)
+	}
+
+	// Vary removed from the page
+	d.SetVary("example.com", "/a/::", d.Generation("example.com"), nil)
+	if vary := d.GetVary("example.com", "/a/::"); vary != nil {
+		t.Errorf("vary = %v", vary)
+	}
+	if _, _, err := d.Get("example.com", variant, "none"); !errors.Is(err, ErrCacheNotFound) {
+		t.Errorf("variant Get = %v", err)
+	}
+	if _, err := os.Stat(d.entryPath("example.com", variant)); err == nil {
+		t.Error("variant left on disk")
+	}
+	if _, ok := d.loadIndex("example.com").keys.Load(variant); ok {
+		t.Error("variant still indexed")
+	}
+}
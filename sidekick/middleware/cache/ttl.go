@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// TTLRule sets the TTL of responses matched by path or status code,
+// used instead of global ttl. 0 or negative TTL means cache forever.
+type TTLRule struct {
+	Path   caddyhttp.MatchPath `json:"path,omitempty"`
+	Status []string            `json:"status,omitempty"` // same format as CacheResponseCodes
+	TTL    int                 `json:"ttl"`
+}
+
+// parseTTLRule parses one line in `ttl_rules` block:
+//
+//	path <path...> <ttl>
+//	status <code...> <ttl>
+func parseTTLRule(d *caddyfile.Dispenser) (TTLRule, error) {
+	rule := TTLRule{}
+	kind := d.Val()
+	args := d.RemainingArgs()
+	if len(args) < 2 {
+		return rule, d.ArgErr()
+	}
+	ttl, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		return rule, d.Errf("invalid ttl value: %v", err)
+	}
+	rule.TTL = ttl
+	args = args[:len(args)-1]
+
+	switch kind {
+	case "path":
+		rule.Path = args
+	case "status":
+		rule.Status = parseStatusCodes(strings.Join(args, ","))
+	default:
+		return rule, d.Errf("unknown ttl rule: %s", kind)
+	}
+	return rule, nil
+}
+
+// Match reports whether the response matches all conditions of the rule
+func (rule *TTLRule) Match(r *http.Request, status int) bool {
+	if len(rule.Path) > 0 && !rule.Path.Match(r) {
+		return false
+	}
+	if len(rule.Status) > 0 && !matchStatusCode(rule.Status, status) {
+		return false
+	}
+	return true
+}
+
+// parseStatusCodes parses comma separated status codes,
+// wildcard (e.g. 2XX, 4XX, 5XX) is kept as single digit
+func parseStatusCodes(value string) []string {
+	codes := strings.Split(strings.TrimSpace(value), ",")
+	list := make([]string, len(codes))
+
+	for i, code := range codes {
+		code = strings.TrimSpace(code)
+		if strings.Contains(code, "XX") {
+			code = string(code[0])
+		}
+		list[i] = code
+	}
+	return list
+}
+
+// matchStatusCode reports whether status in the codes from parseStatusCodes()
+func matchStatusCode(codes []string, status int) bool {
+	statusStr := strconv.Itoa(status)
+	for _, code := range codes {
+		if code == statusStr {
+			return true
+		}
+
+		// code may be single digit because of wildcard usage (e.g. 2XX, 4XX, 5XX)
+		if len(code) == 1 && code == statusStr[0:1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// parseVary returns the sorted canonical header names in response Vary,
+// Accept-Encoding is skipped since every encoding is already stored separately
+func parseVary(hdr http.Header) []string {
+	var vary []string
+	for _, line := range hdr.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			name = http.CanonicalHeaderKey(name)
+			if name == "Accept-Encoding" || slices.Contains(vary, name) {
+				continue
+			}
+			vary = append(vary, name)
+		}
+	}
+	slices.Sort(vary)
+	return vary
+}
+
+// variantKey returns the secondary key of the request for the Vary header names,
+// header values are hashed to keep the key short
+func variantKey(key string, vary []string, reqHdr http.Header) string {
+	h := sha256.New()
+	for _, name := range vary {
+		h.Write([]byte(name))
+		h.Write([]byte{':'})
+		h.Write([]byte(strings.Join(reqHdr.Values(name), ",")))
+		h.Write([]byte{'\n'})
+	}
+	return key + "#" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// mergeVary returns the Vary header value for a cached response
+func mergeVary(vary []string) string {
+	return strings.Join(append([]string{"Accept-Encoding"}, vary...), ", ")
+}
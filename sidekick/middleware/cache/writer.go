@@ -1,16 +1,16 @@
 package cache
 
 import (
+	"fmt"
 	"net/http"
 	"net/url"
 	"slices"
-	"strconv"
 	"sync/atomic"
 
 	"go.uber.org/zap"
 )
 
-func NewCustomWriter(rw http.ResponseWriter, r *http.Request, db *Store, logger *zap.Logger, c *Cache) *CustomWriter {
+func NewCustomWriter(rw http.ResponseWriter, r *http.Request, db *Store, logger *zap.Logger, c *Cache, cacheHost string, cacheKey string) *CustomWriter {
 	nw := CustomWriter{
 		ResponseWriter: rw,
 		Request:        r,
@@ -19,11 +19,23 @@ func NewCustomWriter(rw http.ResponseWriter, r *http.Request, db *Store, logger
 
 		// keep original request info
 		// origHeader: r.Header.Clone(),
-		origUrl: *r.URL,
+		origUrl:   *r.URL,
+		cacheHost: cacheHost,
+		cacheKey:  cacheKey,
+		gen:       db.Generation(cacheHost),
 
 		cacheMaxSize:       c.MemoryItemMaxSize,
 		cacheResponseCodes: c.CacheResponseCodes,
 		cacheHeaderName:    c.CacheHeaderName,
+		cacheHeaders:       c.cacheHeaders,
+		ignoreCacheControl: c.IgnoreCacheControl,
+		ignoreSetCookie:    c.IgnoreSetCookie,
+		ttl:                c.TTL,
+		ttlMin:             c.TTLMin,
+		ttlMax:             c.TTLMax,
+		ttlRules:           c.TTLRules,
+		staleTTL:           c.StaleTTL,
+		staleErrorTTL:      c.StaleErrorTTL,
 		status:             -1,
 	}
 	return &nw
@@ -39,17 +51,50 @@ type CustomWriter struct {
 	*zap.Logger
 	cacheResponseCodes []string
 	cacheHeaderName    string
+	cacheHeaders       []string
 	cacheMaxSize       int
+	ignoreCacheControl bool
+	ignoreSetCookie    bool
+	ttl                int
+	ttlMin             int
+	ttlMax             int
+	ttlRules           []TTLRule
+	staleTTL           int
+	staleErrorTTL      int
+
+	// TTL of the entry, decided on WriteHeader()
+	entryTTL           int
+	entryStaleTTL      int
+	entryStaleErrorTTL int
+
+	// expired entry served instead of upstream error (stale-if-error)
+	stale       *MemCacheItem
+	staleCE     string
+	staleHeader http.Header
+	servedStale bool
+
+	// why the response not cached, for debug
+	bypassReason string
 
 	// origHeader http.Header
 	origUrl url.URL
 
+	// host and key computed by Cache, same as the one used for lookup
+	cacheHost string
+	cacheKey  string
+
+	// generation when request started, dropped if purged after
+	gen uint64
+
 	// -1 means header not send yet
 	status int32
 
 	// flag response data need to be cached
 	needCache int32
 
+	// response stored on Close()
+	stored bool
+
 	// currently cache in memory
 	// assume response data not too large
 	// TODO: buffer pool
@@ -64,11 +109,24 @@ func (r *CustomWriter) Unwrap() http.ResponseWriter {
 func (r *CustomWriter) Close() error {
 	if atomic.LoadInt32(&r.needCache) == 1 {
 		hdr := r.ResponseWriter.Header()
-		meta := NewCacheMeta(int(atomic.LoadInt32(&r.status)), hdr)
+		meta := NewCacheMeta(int(atomic.LoadInt32(&r.status)), hdr, r.cacheHeaders)
 		if meta == nil {
 			return nil
 		}
-		r.Store.Set(r.origUrl.Path, "", meta, r.buf)
+		meta.TTL = r.entryTTL
+		meta.StaleTTL = r.entryStaleTTL
+		meta.StaleErrorTTL = r.entryStaleErrorTTL
+		// validator for conditional requests, same content gives same tag on every node
+		if meta.GetHeader("Etag") == "" && slices.Contains(r.cacheHeaders, "Etag") {
+			meta.Header = append(meta.Header, []string{"Etag", contentETag(r.buf, meta.contentEncoding)})
+		}
+		// record variant index before the variant, so lookup never miss the fresh variant
+		key := r.cacheKey
+		r.Store.SetVary(r.cacheHost, key, r.gen, meta.Vary)
+		if len(meta.Vary) > 0 {
+			key = variantKey(key, meta.Vary, r.Request.Header)
+		}
+		r.stored = r.Store.Set(r.cacheHost, key, r.gen, meta, r.buf) == nil
 	}
 	return nil
 }
@@ -79,31 +137,22 @@ func (r *CustomWriter) Header() http.Header {
 
 func (r *CustomWriter) WriteHeader(status int) {
 	r.Logger.Debug("==========-SetHeader-==========")
+	if status >= 500 && r.ServeStale(fmt.Errorf("upstream status %d", status)) {
+		atomic.StoreInt32(&r.status, int32(status))
+		return
+	}
 	atomic.StoreInt32(&r.status, int32(status))
 
 	r.Logger.Debug("Writing customwriter response", zap.String("path", r.origUrl.Path))
 	bypass := true
+	r.bypassReason = "status"
 
 	// check if the response code is in the cache response codes
 	if bypass {
-		statusStr := strconv.Itoa(status)
-		for _, code := range r.cacheResponseCodes {
-			r.Logger.Debug("Checking status code", zap.String("code", code), zap.String("status", statusStr))
-
-			if code == statusStr {
-				r.Logger.Debug("Caching because of status code", zap.String("code", code), zap.String("status", statusStr))
-				bypass = false
-				break
-			}
-
-			// code may be single digit because of wildcard usage (e.g. 2XX, 4XX, 5XX)
-			if len(code) == 1 {
-				if code == statusStr[0:1] {
-					r.Logger.Debug("Caching because of wildcard", zap.String("code", code), zap.String("status", statusStr))
-					bypass = false
-					break
-				}
-			}
+		if matchStatusCode(r.cacheResponseCodes, status) {
+			r.Logger.Debug("Caching because of status code", zap.Int("status", status))
+			bypass = false
+			r.bypassReason = ""
 		}
 	}
 
@@ -112,16 +161,43 @@ func (r *CustomWriter) WriteHeader(status int) {
 	hdr := r.Header()
 
 	// check if response should not cached
-	for h := range hdr {
-		ok := slices.Contains(hdrResNotCacheList, h)
-		if ok {
+	if !bypass {
+		for h := range hdr {
+			ok := slices.Contains(hdrResNotCacheList, h)
+			if ok {
+				bypass = true
+				r.bypassReason = "header " + h
+				break
+			}
+		}
+	}
+
+	// `Vary: *` never match any request
+	if !bypass && slices.Contains(parseVary(hdr), "*") {
+		bypass = true
+		r.bypassReason = "vary *"
+	}
+
+	// Cache-Control, Pragma and Set-Cookie from backend
+	if !bypass {
+		r.bypassReason = r.uncacheableReason(hdr)
+		bypass = r.bypassReason != ""
+	}
+
+	// freshness from s-maxage, max-age or Expires
+	if !bypass {
+		r.entryTTL = r.decideTTL(hdr)
+		if r.entryTTL == 0 {
 			bypass = true
-			break
+			r.bypassReason = "stale"
 		}
+		r.entryStaleTTL = r.decideStaleTTL(hdr)
+		r.entryStaleErrorTTL = r.decideStaleErrorTTL(hdr)
 	}
 
 	cacheState := "BYPASS"
 	if bypass {
+		r.Logger.Debug("Bypass caching", zap.String("path", r.origUrl.Path), zap.String("reason", r.bypassReason))
 		hdr.Set(r.cacheHeaderName, cacheState)
 		r.ResponseWriter.WriteHeader(status)
 		return
@@ -130,12 +206,49 @@ func (r *CustomWriter) WriteHeader(status int) {
 	atomic.StoreInt32(&r.needCache, 1)
 	cacheState = "MISS"
 
-	// TODO: prevent multiple CustomWriter cache when concurrent request same page (same cacheKey)
-
 	hdr.Set(r.cacheHeaderName, cacheState)
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// SetStale keeps an expired entry, served if upstream failed
+func (r *CustomWriter) SetStale(value []byte, meta *CacheMeta, ce string) {
+	r.stale = &MemCacheItem{
+		CacheMeta: meta,
+		value:     value,
+	}
+	r.staleCE = ce
+	// headers set by handlers before this, without any header from upstream
+	r.staleHeader = r.ResponseWriter.Header().Clone()
+}
+
+// ServeStale writes the expired entry instead of the upstream error, if there is one,
+// and nothing written to the client yet.
+// Reports whether the stale entry served.
+func (r *CustomWriter) ServeStale(reason error) bool {
+	if r.stale == nil || r.servedStale {
+		return r.servedStale
+	}
+	// headers already sent
+	if atomic.LoadInt32(&r.status) != -1 {
+		return false
+	}
+
+	r.Logger.Warn("wp cache - serve stale on error", zap.String("path", r.origUrl.Path), zap.String("cache_status", "STALE-IF-ERROR"), zap.Error(reason))
+	r.servedStale = true
+	atomic.StoreInt32(&r.needCache, 0)
+
+	// drop headers from upstream, like Content-Encoding set by encode
+	hdr := r.ResponseWriter.Header()
+	for k := range hdr {
+		delete(hdr, k)
+	}
+	for k, v := range r.staleHeader {
+		hdr[k] = v
+	}
+	writeCacheResponse(r.ResponseWriter, r.Request, r.cacheHeaderName, "STALE-IF-ERROR", r.stale.CacheMeta, r.staleCE, r.stale.value)
+	return true
+}
+
 // Write will write the response body
 func (r *CustomWriter) Write(b []byte) (int, error) {
 	// check header has been written or not
@@ -143,6 +256,11 @@ func (r *CustomWriter) Write(b []byte) (int, error) {
 		r.WriteHeader(200)
 	}
 
+	// discard upstream error body
+	if r.servedStale {
+		return len(b), nil
+	}
+
 	// save response data
 	if atomic.LoadInt32(&r.needCache) == 1 {
 		sz := len(r.buf) + len(b)
@@ -154,6 +272,7 @@ func (r *CustomWriter) Write(b []byte) (int, error) {
 			// too large, skip cache in memory
 			atomic.StoreInt32(&r.needCache, 0)
 			r.buf = nil
+			r.bypassReason = "size"
 
 			r.Logger.Debug("Bypass caching because of data size", zap.Int("sz", sz), zap.Int("limit", r.cacheMaxSize))
 		}